@@ -3,23 +3,33 @@ module github.com/breeswish/mockngm
 go 1.18
 
 require (
+	github.com/gogo/protobuf v1.3.1
+	github.com/google/go-cmp v0.5.5
 	github.com/pingcap/kvproto v0.0.0-20220329054531-29c9119f3c95
 	github.com/pingcap/log v0.0.0-20211215031037-e024ba4eb0ee
 	github.com/pingcap/tipb v0.0.0-20220107024056-3b91949a18a7
+	github.com/prometheus/client_golang v1.12.2
+	go.uber.org/atomic v1.9.0
+	go.uber.org/goleak v1.1.11
+	go.uber.org/multierr v1.7.0
 	go.uber.org/zap v1.21.0
 	google.golang.org/grpc v1.45.0
 )
 
 require (
 	github.com/benbjohnson/clock v1.1.0 // indirect
-	github.com/gogo/protobuf v1.3.1 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
-	go.uber.org/atomic v1.9.0 // indirect
-	go.uber.org/multierr v1.7.0 // indirect
-	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4 // indirect
-	golang.org/x/sys v0.0.0-20210510120138-977fb7262007 // indirect
-	golang.org/x/text v0.3.3 // indirect
-	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	golang.org/x/net v0.0.0-20210525063256-abc453219eb5 // indirect
+	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9 // indirect
+	golang.org/x/text v0.3.6 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	google.golang.org/genproto v0.0.0-20200825200019-8632dd797987 // indirect
 	google.golang.org/protobuf v1.26.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
 )
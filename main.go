@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net/url"
 	"strings"
 	"sync"
@@ -21,13 +22,21 @@ func main() {
 	wg := sync.WaitGroup{}
 	targetsArr := strings.Split(*targets, ",")
 	for _, target := range targetsArr {
+		if !strings.Contains(target, "://") {
+			// A bare address, whose kind is guessed from the port.
+			kind, ok := utils.InferKind(target)
+			if !ok {
+				log.Fatal("Cannot infer component from target address", zap.String("target", target))
+			}
+			target = fmt.Sprintf("%s://%s", kind, target)
+		}
 		parsed, err := url.Parse(target)
 		if err != nil {
 			log.Fatal("Parse target address failed", zap.String("target", target), zap.Error(err))
 		}
 		wg.Add(1)
 
-		if parsed.Scheme != "tidb" && parsed.Scheme != "tikv" {
+		if parsed.Scheme != "tidb" && parsed.Scheme != "tikv" && parsed.Scheme != "tiflash" && parsed.Scheme != "tidb+tikv" {
 			log.Fatal("Unsupported component", zap.String("component", parsed.Scheme), zap.String("target", target))
 		}
 
@@ -38,7 +47,9 @@ func main() {
 		s := topsql.NewScraper(context.Background(), c, nil)
 		wg.Add(1)
 		go func() {
-			s.Run()
+			if err := s.Run(); err != nil {
+				log.Error("Scraper stopped", zap.Stringer("target", c), zap.Error(err))
+			}
 		}()
 	}
 
@@ -0,0 +1,210 @@
+package topsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var errAckQueueClosed = errors.New("ack queue closed")
+
+// AckQueue delivers records to a consumer at least once: a record received
+// by Recv stays in flight until it is acked, and is delivered again if it is
+// nacked or not acked within the ack timeout, e.g. because writing it to a
+// sink failed midway.
+//
+// Handle blocks while limit records are queued or in flight, which in turn
+// stops the scraper from reading its target, so memory is bounded by limit
+// records. A scraper blocked in Handle cannot be closed, as Close waits for
+// the handler to return, so the queue must be closed first when the consumer
+// may stop receiving, or the scraper fed by HandleContext with a context
+// cancelled on shutdown. Records are received in the order they are handled, except for
+// redelivered ones, which are received before any newer record, so the
+// consumer must tolerate both duplicates and records out of order. Records
+// are kept after Handle returns, so scrapers feeding a queue must not enable
+// PoolRecords.
+type AckQueue struct {
+	limit   int
+	timeout time.Duration
+
+	mu       sync.Mutex
+	seq      uint64
+	pending  []*ackEntry // redelivered records come first
+	inflight map[uint64]*ackEntry
+	changed  chan struct{} // closed and replaced on every change
+	closed   bool
+}
+
+type ackEntry struct {
+	id          uint64
+	record      ScrapedRecord
+	attempt     int
+	deliveredAt time.Time
+	deadline    time.Time
+}
+
+// AckRecord is a record received from an AckQueue, to be acked or nacked
+// once processed.
+type AckRecord struct {
+	ScrapedRecord
+	// Attempt is the number of times the record has been delivered,
+	// starting from 1.
+	Attempt int
+
+	q  *AckQueue
+	id uint64
+}
+
+// NewAckQueue creates a queue of up to limit records queued or in flight,
+// delivering again the records not acked within timeout. Both must be
+// positive.
+func NewAckQueue(limit int, timeout time.Duration) (*AckQueue, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid ack queue limit %d: must be positive", limit)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("invalid ack timeout %v: must be positive", timeout)
+	}
+	return &AckQueue{
+		limit:    limit,
+		timeout:  timeout,
+		inflight: make(map[uint64]*ackEntry),
+		changed:  make(chan struct{}),
+	}, nil
+}
+
+// Handle is a RecordHandler queueing the record, blocking while the queue is
+// full. It fails once the queue is closed.
+func (q *AckQueue) Handle(record ScrapedRecord) error {
+	return q.HandleContext(context.Background(), record)
+}
+
+// HandleContext is Handle, also failing with the error of ctx once ctx is
+// done while the queue is full.
+func (q *AckQueue) HandleContext(ctx context.Context, record ScrapedRecord) error {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return errAckQueueClosed
+		}
+		if len(q.pending)+len(q.inflight) < q.limit {
+			q.seq++
+			q.pending = append(q.pending, &ackEntry{id: q.seq, record: record})
+			q.notifyLocked()
+			q.mu.Unlock()
+			return nil
+		}
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Recv returns the next record to process, blocking until there is one. It
+// returns io.EOF once the queue is closed and every record has been acked.
+func (q *AckQueue) Recv(ctx context.Context) (AckRecord, error) {
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		next := q.expireLocked(now)
+		if len(q.pending) > 0 {
+			e := q.pending[0]
+			q.pending = q.pending[1:]
+			e.attempt++
+			e.deliveredAt = now
+			e.deadline = now.Add(q.timeout)
+			q.inflight[e.id] = e
+			ackInFlightGauge.Inc()
+			q.mu.Unlock()
+			return AckRecord{ScrapedRecord: e.record, Attempt: e.attempt, q: q, id: e.id}, nil
+		}
+		if q.closed && len(q.inflight) == 0 {
+			q.mu.Unlock()
+			return AckRecord{}, io.EOF
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(now))
+			expired = timer.C
+		}
+		select {
+		case <-changed:
+		case <-expired:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return AckRecord{}, err
+		}
+	}
+}
+
+// expireLocked moves records not acked in time back to pending, returning
+// the earliest deadline of the remaining in flight records, if any.
+func (q *AckQueue) expireLocked(now time.Time) (next time.Time) {
+	for id, e := range q.inflight {
+		if !e.deadline.After(now) {
+			delete(q.inflight, id)
+			ackInFlightGauge.Dec()
+			q.pending = append([]*ackEntry{e}, q.pending...)
+			continue
+		}
+		if next.IsZero() || e.deadline.Before(next) {
+			next = e.deadline
+		}
+	}
+	return next
+}
+
+// Close makes blocked and future Handle calls fail. Records already queued
+// are still received by Recv.
+func (q *AckQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notifyLocked()
+}
+
+func (q *AckQueue) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Ack marks the record as processed. Acking a record after its ack timeout
+// is a no-op, as it is redelivered already.
+func (r AckRecord) Ack() {
+	r.q.mu.Lock()
+	defer r.q.mu.Unlock()
+	if e, ok := r.q.inflight[r.id]; ok && e.attempt == r.Attempt {
+		delete(r.q.inflight, r.id)
+		ackInFlightGauge.Dec()
+		ackLatency.Observe(time.Since(e.deliveredAt).Seconds())
+		r.q.notifyLocked()
+	}
+}
+
+// Nack marks the record as failed, to be delivered again before newer ones.
+func (r AckRecord) Nack() {
+	r.q.mu.Lock()
+	defer r.q.mu.Unlock()
+	if e, ok := r.q.inflight[r.id]; ok && e.attempt == r.Attempt {
+		delete(r.q.inflight, r.id)
+		ackInFlightGauge.Dec()
+		r.q.pending = append([]*ackEntry{e}, r.q.pending...)
+		r.q.notifyLocked()
+	}
+}
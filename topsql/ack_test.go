@@ -0,0 +1,152 @@
+package topsql
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func newTestAckQueue(t *testing.T, limit int, timeout time.Duration) *AckQueue {
+	q, err := NewAckQueue(limit, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func recvAck(t *testing.T, q *AckQueue) AckRecord {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := q.Recv(ctx)
+	if err != nil {
+		t.Fatalf("Recv = %v", err)
+	}
+	return r
+}
+
+func TestNewAckQueueRejectsInvalidArguments(t *testing.T) {
+	for _, tc := range []struct {
+		limit   int
+		timeout time.Duration
+	}{
+		{0, time.Second},
+		{-1, time.Second},
+		{1, 0},
+		{1, -time.Second},
+	} {
+		if q, err := NewAckQueue(tc.limit, tc.timeout); err == nil || q != nil {
+			t.Errorf("NewAckQueue(%d, %v) = %v, %v, want an error", tc.limit, tc.timeout, q, err)
+		}
+	}
+}
+
+func TestAckQueueRedeliversNacked(t *testing.T) {
+	q := newTestAckQueue(t, 2, time.Hour)
+	first, second := testRecord(), testRecord()
+	for _, r := range []ScrapedRecord{first, second} {
+		if err := q.Handle(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := recvAck(t, q)
+	if r.TiDB != first.TiDB || r.Attempt != 1 {
+		t.Fatalf("got record %p attempt %d, want the first one at attempt 1", r.TiDB, r.Attempt)
+	}
+	r.Nack()
+	// A nacked record comes before newer ones.
+	r = recvAck(t, q)
+	if r.TiDB != first.TiDB || r.Attempt != 2 {
+		t.Fatalf("got record %p attempt %d, want the first one at attempt 2", r.TiDB, r.Attempt)
+	}
+	r.Ack()
+	if r = recvAck(t, q); r.TiDB != second.TiDB {
+		t.Fatal("want the second record after acking the first")
+	}
+	r.Ack()
+
+	q.Close()
+	if _, err := q.Recv(context.Background()); err != io.EOF {
+		t.Errorf("Recv after Close = %v, want io.EOF", err)
+	}
+}
+
+func TestAckQueueRedeliversAfterTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	q := newTestAckQueue(t, 1, timeout)
+	if err := q.Handle(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := recvAck(t, q)
+	start := time.Now()
+	r := recvAck(t, q)
+	if elapsed := time.Since(start); elapsed < timeout/2 {
+		t.Errorf("redelivered after %v, want after the ack timeout of %v", elapsed, timeout)
+	}
+	if r.Attempt != 2 {
+		t.Errorf("Attempt = %d, want 2", r.Attempt)
+	}
+	// Acking the stale delivery is a no-op, so the queue stays full.
+	stale.Ack()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.HandleContext(ctx, testRecord()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("HandleContext on a full queue = %v, want DeadlineExceeded", err)
+	}
+	r.Ack()
+	if err := q.Handle(testRecord()); err != nil {
+		t.Errorf("Handle after Ack = %v, want nil", err)
+	}
+}
+
+func TestAckQueueUnblocksHandle(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// handle blocks on a full queue until unblock is called.
+		handle  func(q *AckQueue, ctx context.Context) error
+		unblock func(q *AckQueue, cancel context.CancelFunc)
+		want    error
+	}{
+		{
+			name:    "close",
+			handle:  func(q *AckQueue, ctx context.Context) error { return q.Handle(testRecord()) },
+			unblock: func(q *AckQueue, cancel context.CancelFunc) { q.Close() },
+			want:    errAckQueueClosed,
+		},
+		{
+			name:    "context",
+			handle:  func(q *AckQueue, ctx context.Context) error { return q.HandleContext(ctx, testRecord()) },
+			unblock: func(q *AckQueue, cancel context.CancelFunc) { cancel() },
+			want:    context.Canceled,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newTestAckQueue(t, 1, time.Hour)
+			if err := q.Handle(testRecord()); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errCh := make(chan error, 1)
+			go func() { errCh <- tc.handle(q, ctx) }()
+
+			select {
+			case err := <-errCh:
+				t.Fatalf("Handle on a full queue returned %v", err)
+			case <-time.After(20 * time.Millisecond):
+			}
+			tc.unblock(q, cancel)
+			select {
+			case err := <-errCh:
+				if !errors.Is(err, tc.want) {
+					t.Errorf("Handle = %v, want %v", err, tc.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Handle still blocked")
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package topsql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/atomic"
+)
+
+// DigestStat is the resource usage of a SQL digest and plan digest pair.
+// TiDB reports the execution count, while TiKV reports read and write keys.
+type DigestStat struct {
+	SQLDigest  []byte
+	PlanDigest []byte
+	CPUTimeMs  uint64
+	ExecCount  uint64
+	ReadKeys   uint64
+	WriteKeys  uint64
+}
+
+func (d *DigestStat) merge(other DigestStat) {
+	d.CPUTimeMs += other.CPUTimeMs
+	d.ExecCount += other.ExecCount
+	d.ReadKeys += other.ReadKeys
+	d.WriteKeys += other.WriteKeys
+}
+
+// forEachDataPoint calls f with the usage of every data point in the record.
+// Records without data points, e.g. SQL and plan metas, are skipped.
+func forEachDataPoint(record ScrapedRecord, f func(timestampSec uint64, stat DigestStat)) {
+	if r := record.TiDB.GetRecord(); r != nil {
+		for _, item := range r.Items {
+			f(item.TimestampSec, DigestStat{
+				SQLDigest:  r.SqlDigest,
+				PlanDigest: r.PlanDigest,
+				CPUTimeMs:  uint64(item.CpuTimeMs),
+				ExecCount:  item.StmtExecCount,
+			})
+		}
+	}
+	if r := record.TiKV.GetRecord(); r != nil {
+		var tag tipb.ResourceGroupTag
+		_ = tag.Unmarshal(r.ResourceGroupTag)
+		for _, item := range r.Items {
+			f(item.TimestampSec, DigestStat{
+				SQLDigest:  tag.SqlDigest,
+				PlanDigest: tag.PlanDigest,
+				CPUTimeMs:  uint64(item.CpuTimeMs),
+				ReadKeys:   uint64(item.ReadKeys),
+				WriteKeys:  uint64(item.WriteKeys),
+			})
+		}
+	}
+}
+
+type digestKey struct {
+	sql  string
+	plan string
+}
+
+type digestStats map[digestKey]*DigestStat
+
+// add merges stat into the stats of its digests. The digests are copied, as
+// they belong to the record, which may be released once handled.
+func (s digestStats) add(stat DigestStat) {
+	key := digestKey{sql: string(stat.SQLDigest), plan: string(stat.PlanDigest)}
+	if d, ok := s[key]; ok {
+		d.merge(stat)
+		return
+	}
+	stat.SQLDigest = append([]byte(nil), stat.SQLDigest...)
+	stat.PlanDigest = append([]byte(nil), stat.PlanDigest...)
+	s[key] = &stat
+}
+
+// top returns the n stats with the most CPU time, ties broken by digests.
+func (s digestStats) top(n int) []DigestStat {
+	stats := make([]DigestStat, 0, len(s))
+	for _, d := range s {
+		stats = append(stats, *d)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].CPUTimeMs != stats[j].CPUTimeMs {
+			return stats[i].CPUTimeMs > stats[j].CPUTimeMs
+		}
+		if c := bytes.Compare(stats[i].SQLDigest, stats[j].SQLDigest); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(stats[i].PlanDigest, stats[j].PlanDigest) < 0
+	})
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// WindowedAggregator sums the usage of records received within every window
+// of time, and emits the top n digests by CPU time once the window elapses.
+type WindowedAggregator struct {
+	window time.Duration
+	n      int
+	emit   func([]DigestStat)
+
+	// Align aligns windows to multiples of the window length in wall clock
+	// time, e.g. every minute at :00, so that windows of different collectors
+	// are comparable. The partial window from when Run is called to the first
+	// boundary is discarded, so that every emitted window is complete, except
+	// for the last one emitted on return. It must be set before Run.
+	Align bool
+
+	mu    sync.Mutex
+	stats digestStats
+}
+
+func NewWindowedAggregator(window time.Duration, n int, emit func([]DigestStat)) *WindowedAggregator {
+	return &WindowedAggregator{
+		window: window,
+		n:      n,
+		emit:   emit,
+		stats:  make(digestStats),
+	}
+}
+
+// Handle is a RecordHandler adding the record to the current window.
+func (a *WindowedAggregator) Handle(record ScrapedRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	forEachDataPoint(record, func(_ uint64, stat DigestStat) {
+		a.stats.add(stat)
+	})
+	return nil
+}
+
+// Run emits a window every time it elapses, until ctx is done. The last,
+// partial window is emitted before returning.
+func (a *WindowedAggregator) Run(ctx context.Context) {
+	if a.Align {
+		a.runAligned(ctx)
+		return
+	}
+	ticker := time.NewTicker(a.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-ctx.Done():
+			a.flush()
+			return
+		}
+	}
+}
+
+func (a *WindowedAggregator) runAligned(ctx context.Context) {
+	first := true
+	for {
+		// Computed every time rather than using a ticker, which would drift.
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(a.window).Add(a.window).Sub(now))
+		select {
+		case <-timer.C:
+			if first {
+				a.discard()
+				first = false
+			} else {
+				a.flush()
+			}
+		case <-ctx.Done():
+			timer.Stop()
+			a.flush()
+			return
+		}
+	}
+}
+
+func (a *WindowedAggregator) discard() {
+	a.mu.Lock()
+	a.stats = make(digestStats)
+	a.mu.Unlock()
+}
+
+func (a *WindowedAggregator) flush() {
+	a.mu.Lock()
+	top := a.stats.top(a.n)
+	a.stats = make(digestStats)
+	a.mu.Unlock()
+
+	a.emit(top)
+}
+
+var errAggregatorClosed = errors.New("aggregator closed")
+
+// AggregatedWindow is the top digests by CPU time of a window of data point
+// timestamps, within [Start, End).
+type AggregatedWindow struct {
+	Start time.Time
+	End   time.Time
+	Top   []DigestStat
+}
+
+// Aggregator is a Sink summing the usage of records within tumbling windows,
+// and emitting the top n digests by CPU time of every window once it closes.
+// Unlike WindowedAggregator, data points are bucketed by their own timestamp
+// rather than by when the record is received, so that a record spanning a
+// window boundary contributes to both windows.
+//
+// A window closes on the first Flush after its end, plus Lateness, has passed
+// in wall clock time. Data points of closed windows are dropped and counted in
+// Late. Close emits all windows left, including unfinished ones.
+type Aggregator struct {
+	window time.Duration
+	n      int
+
+	// Lateness is how long after its end a window keeps accepting data
+	// points, as targets report them with a delay. It must be set before
+	// the first Write.
+	Lateness time.Duration
+
+	mu          sync.Mutex
+	windows     map[int64]digestStats // by start in unix seconds
+	closedUntil int64                 // windows starting before are emitted
+	closed      bool
+
+	flushMu sync.Mutex
+	results chan AggregatedWindow
+	late    atomic.Uint64
+}
+
+var _ Sink = (*Aggregator)(nil)
+
+// NewAggregator returns an Aggregator of windows of the given size, which is
+// rounded to whole seconds like the timestamps of data points.
+func NewAggregator(window time.Duration, n int) *Aggregator {
+	if window < time.Second {
+		window = time.Second
+	}
+	return &Aggregator{
+		window:  window.Round(time.Second),
+		n:       n,
+		windows: make(map[int64]digestStats),
+		results: make(chan AggregatedWindow, 16),
+	}
+}
+
+// Results returns the closed windows, in the order of their start. It must be
+// consumed, as Flush blocks while it is full. It is closed by Close.
+func (a *Aggregator) Results() <-chan AggregatedWindow {
+	return a.results
+}
+
+// Late returns the number of data points dropped as their windows had closed.
+func (a *Aggregator) Late() uint64 {
+	return a.late.Load()
+}
+
+func (a *Aggregator) Write(record ScrapedRecord) error {
+	size := int64(a.window / time.Second)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return errAggregatorClosed
+	}
+	forEachDataPoint(record, func(ts uint64, stat DigestStat) {
+		start := int64(ts) - int64(ts)%size
+		if start < a.closedUntil {
+			a.late.Inc()
+			return
+		}
+		stats, ok := a.windows[start]
+		if !ok {
+			stats = make(digestStats)
+			a.windows[start] = stats
+		}
+		stats.add(stat)
+	})
+	return nil
+}
+
+// Flush emits the windows which have closed.
+func (a *Aggregator) Flush() error {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+	return a.flush(time.Now(), false)
+}
+
+// Close emits all windows left and closes Results.
+func (a *Aggregator) Close() error {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+	if err := a.flush(time.Time{}, true); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+	close(a.results)
+	return nil
+}
+
+// Run flushes every window until ctx is done.
+func (a *Aggregator) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = a.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flush emits the windows closed as of now, or all windows if all is set.
+// It is called with flushMu held, keeping the windows emitted in order.
+func (a *Aggregator) flush(now time.Time, all bool) error {
+	size := int64(a.window / time.Second)
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return errAggregatorClosed
+	}
+	var ready []AggregatedWindow
+	for start, stats := range a.windows {
+		end := time.Unix(start+size, 0)
+		if !all && end.Add(a.Lateness).After(now) {
+			continue
+		}
+		ready = append(ready, AggregatedWindow{Start: time.Unix(start, 0), End: end, Top: stats.top(a.n)})
+		delete(a.windows, start)
+		if start+size > a.closedUntil {
+			a.closedUntil = start + size
+		}
+	}
+	a.mu.Unlock()
+
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].Start.Before(ready[j].Start)
+	})
+	for _, window := range ready {
+		a.results <- window
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package topsql
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/atomic"
+)
+
+// memoryBudget bounds the total size of records in flight across the
+// scrapers of a pool.
+type memoryBudget struct {
+	limit int64
+	drop  bool
+
+	mu      sync.Mutex
+	used    int64
+	freed   chan struct{} // closed and replaced whenever memory is released
+	dropped atomic.Uint64
+}
+
+func newMemoryBudget(limit int64, drop bool) *memoryBudget {
+	return &memoryBudget{
+		limit: limit,
+		drop:  drop,
+		freed: make(chan struct{}),
+	}
+}
+
+// acquire reserves size bytes, waiting for memory to be released or dropping
+// the record when over the budget. A single record larger than the whole
+// budget is admitted once nothing else is in flight. It returns false if the
+// record is to be dropped or ctx is done.
+func (b *memoryBudget) acquire(ctx context.Context, size int) bool {
+	for {
+		b.mu.Lock()
+		if b.used == 0 || b.used+int64(size) <= b.limit {
+			b.used += int64(size)
+			b.mu.Unlock()
+			return true
+		}
+		if b.drop {
+			b.mu.Unlock()
+			b.dropped.Inc()
+			return false
+		}
+		freed := b.freed
+		b.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (b *memoryBudget) release(size int) {
+	b.mu.Lock()
+	b.used -= int64(size)
+	close(b.freed)
+	b.freed = make(chan struct{})
+	b.mu.Unlock()
+}
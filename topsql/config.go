@@ -0,0 +1,817 @@
+package topsql
+
+import (
+	"context"
+	"net"
+	"runtime/debug"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+const (
+	LoadBalancingPickFirst  = "pick_first"
+	LoadBalancingRoundRobin = "round_robin"
+)
+
+// DefaultUserAgent is mockngm/<version>, with the version of the module this
+// package is built from, or "devel" if it is unknown.
+var DefaultUserAgent = "mockngm/" + moduleVersion()
+
+func moduleVersion() string {
+	const path = "github.com/breeswish/mockngm"
+	version := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == path {
+			version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == path {
+				version = dep.Version
+			}
+		}
+	}
+	if version == "" || version == "(devel)" {
+		return "devel"
+	}
+	return version
+}
+
+// TeePolicy decides what happens to a record when ScraperConfig.Tee is full.
+type TeePolicy int
+
+const (
+	// TeeDrop skips copying the record, counting it in Stats.TeeDropped.
+	TeeDrop TeePolicy = iota
+	// TeeBlock waits for room in the channel, stalling the scrape loop.
+	TeeBlock
+)
+
+// RetryDecision is how a failed Subscribe or Recv is handled.
+type RetryDecision int
+
+const (
+	// RetryDecisionReconnect closes the connection and dials the target again.
+	RetryDecisionReconnect RetryDecision = iota
+	// RetryDecisionRetry subscribes again over the same connection.
+	RetryDecisionRetry
+	// RetryDecisionAbort stops scraping, making Run return an error wrapping
+	// ErrAborted.
+	RetryDecisionAbort
+)
+
+// ScrapeMode is how a scraper subscribes to its target.
+type ScrapeMode int
+
+const (
+	// ModeStreaming keeps a single subscription open and receives records as
+	// the target sends them.
+	ModeStreaming ScrapeMode = iota
+	// ModePolling subscribes every ScraperConfig.PollInterval, receives the
+	// records sent within ScraperConfig.PollWindow and ends the subscription
+	// again, for gateways not supporting long-lived streams.
+	ModePolling
+)
+
+// DefaultRetryPolicy aborts on Unimplemented, as the target does not serve
+// Top SQL data at all, and reconnects on any other code.
+func DefaultRetryPolicy(code codes.Code) RetryDecision {
+	if code == codes.Unimplemented {
+		return RetryDecisionAbort
+	}
+	return RetryDecisionReconnect
+}
+
+type ScraperConfig struct {
+	DialTimeout      time.Duration
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// FailoverAddrs are further addresses of the component, e.g. of an HA
+	// setup. An address failing to connect or subscribe fails over to the
+	// next one right away, so that a retry only waits once all addresses
+	// failed. A broken stream is re-established at the same address first.
+	FailoverAddrs []string
+	// Compressor is the name of a registered compressor, e.g. "gzip", to
+	// compress Subscribe streams with. It is empty by default, meaning no
+	// compression. If the target rejects the compressor, the scraper falls
+	// back to subscribing without compression.
+	Compressor string
+	// ConnectBackoff is the backoff of gRPC between connection attempts
+	// within a single dial.
+	ConnectBackoff backoff.Config
+	// MaxRecvMsgSize is the maximum size in bytes of a single received record.
+	MaxRecvMsgSize int
+
+	// FirstWaitTime is the wait time before the first retry of a failed
+	// reconnect. It doubles after each further retry, up to 5 minutes or
+	// FirstWaitTime itself if longer.
+	FirstWaitTime time.Duration
+	// MaxRetryTimes limits retries of failed dials in a reconnect, while
+	// MaxSubscribeRetryTimes separately limits retries of failed subscriptions
+	// over established connections, e.g. to give up soon on a target
+	// rejecting Subscribe. The latter defaults to MaxRetryTimes when zero,
+	// while MaxRetryTimes must be positive.
+	MaxRetryTimes          uint
+	MaxSubscribeRetryTimes uint
+	// FirstRecvRetryTimes is the number of times a stream failing before its
+	// first record is subscribed again over the same connection, before the
+	// failure counts as a failed subscription and the target is re-dialed.
+	FirstRecvRetryTimes uint
+	// RetryPolicy decides by the gRPC code how a failed Subscribe or Recv is
+	// handled. Retried attempts still count against the retry budgets.
+	// DefaultRetryPolicy is used when nil.
+	RetryPolicy func(codes.Code) RetryDecision
+	// ReconnectOnStreamClose makes the scraper reconnect, like on a transient
+	// error, once the target ends the stream on purpose, i.e. with io.EOF, or
+	// closes it on a graceful shutdown. By default scraping ends cleanly
+	// then, as the target asked for it, and Run returns nil. Set it for
+	// targets expected to come back, e.g. across rolling restarts. Scraping
+	// over ScraperConfig.Conn always ends with the stream, as the connection
+	// cannot be re-established.
+	ReconnectOnStreamClose bool
+	// RetryLogLevel is the level of logs of consecutive failed attempts after
+	// the first one, which is always logged as a warning. Lower it to quiet
+	// down targets known to be flaky.
+	RetryLogLevel zapcore.Level
+	// FailureLogInterval limits the logs of failed attempts to connect to
+	// the target to one per interval, the next one telling how many were
+	// suppressed. Zero means no limit. Logs of the scraper giving up are
+	// never suppressed. See also SetFailureLogLimit, which limits the logs of
+	// all scrapers.
+	FailureLogInterval time.Duration
+	// RecordLogLevel is the level of the log summarizing the records received
+	// every second. Lower it to silence the summaries.
+	RecordLogLevel zapcore.Level
+	// StartupGracePeriod quiets down failures to connect to the target right
+	// after the scraper is created, which are expected when the target is
+	// started at the same time, by logging them at debug level until the
+	// first subscription or until the period elapses.
+	StartupGracePeriod time.Duration
+	// AdaptiveBackoff shortens the first wait of a reconnect after a long
+	// lasting subscription, and lengthens it after reconnects needing many
+	// retries, within 1/8 to 8 times FirstWaitTime.
+	AdaptiveBackoff bool
+	// RecvTimeout bounds how long to wait for a single record, including the
+	// first one of a new stream, after which the stream is considered dead
+	// and re-established. Zero disables the limit.
+	RecvTimeout time.Duration
+	// MaxStreamLifetime re-subscribes once a stream has lasted this long,
+	// whether records keep arriving or not, as streams through some proxies
+	// stop delivering after many hours while staying connected. The stream is
+	// re-established over the same connection, after the record being
+	// handled, if any, is delivered. Zero disables the limit.
+	MaxStreamLifetime time.Duration
+	// Mode selects between one long-lived subscription and polling, see
+	// ScrapeMode. With ModePolling, every poll subscribes over the current
+	// connection, reconnecting and retrying as usual, and lasts PollWindow
+	// from Subscribe, whether records arrive or not. PollWindow must not
+	// exceed PollInterval, and replaces MaxStreamLifetime.
+	//
+	// Polling trades freshness for compatibility: records are delivered up to
+	// PollInterval minus PollWindow later than they would be streamed, and
+	// data produced between polls is lost, as targets only send data
+	// produced while subscribed. Between polls the scraper counts as
+	// subscribed in Health, Status and Stats, and every poll as a reconnect.
+	Mode         ScrapeMode
+	PollInterval time.Duration
+	PollWindow   time.Duration
+	// MinReconnectInterval is the minimum interval between the starts of two
+	// reconnect cycles.
+	MinReconnectInterval time.Duration
+	// DegradedThreshold is how long a scraper may be without a stream, e.g.
+	// reconnecting, before Health reports it as down instead of degraded.
+	DegradedThreshold time.Duration
+
+	// LoadBalancingPolicy is the gRPC load balancing policy used when the
+	// target address resolves to multiple backends (e.g. a headless service).
+	// Defaults to LoadBalancingPickFirst.
+	LoadBalancingPolicy string
+	// ServiceConfig is a gRPC service config in JSON, e.g. to set method level
+	// timeouts or retry policies. It replaces the one derived from
+	// LoadBalancingPolicy, so it should carry the load balancing config, if
+	// any. A malformed config stops the scraper before dialing.
+	ServiceConfig string
+	// UserAgent identifies the scraper to the target, e.g. in its logs.
+	// Defaults to DefaultUserAgent. gRPC appends its own user agent to it.
+	UserAgent string
+
+	// FastRateWindow and SlowRateWindow are the decay windows of the moving
+	// averages of the record rate reported in Stats.
+	FastRateWindow time.Duration
+	SlowRateWindow time.Duration
+
+	// ClockSkewThreshold is the difference between the timestamps of records
+	// and the local clock beyond which a warning is logged. Records are
+	// reported in batches, so a difference of up to a minute is normal. Zero
+	// disables the warning.
+	ClockSkewThreshold time.Duration
+
+	// ResourceGroupAllowlist and ResourceGroupDenylist filter TiKV records by
+	// their resource group tag, a tipb.ResourceGroupTag. It carries no resource
+	// group name, so an item is matched against the SQL digest of the tag,
+	// given hex encoded, or its label, given by name, e.g.
+	// ResourceGroupTagLabelRow. When the allowlist is not empty, only records
+	// matching an item of it are kept. Records matching an item of the
+	// denylist are always dropped.
+	ResourceGroupAllowlist []string
+	ResourceGroupDenylist  []string
+	// SQLDigestAllowlist keeps only TiDB and TiKV records of the listed hex
+	// encoded SQL digests, along with the SQL metas of them and all plan
+	// metas, when not empty.
+	//
+	// All filters are applied client side, as neither TiDB nor TiKV supports
+	// filtering subscriptions: the target still sends every record, and the
+	// ones not matching are dropped once received, before reaching the
+	// handler, and counted in Stats.Filtered.
+	SQLDigestAllowlist []string
+	// DedupWindow drops records whose data points, identified by their
+	// digests and timestamps, were all received before within this long of
+	// the latest timestamp, counting them in Stats.Duplicates. Targets often
+	// replay the current window after a reconnect, which would otherwise
+	// count the same CPU time twice. Zero disables deduplication.
+	DedupWindow time.Duration
+
+	// SessionID identifies the scrape session in records and metrics. A
+	// random ID is generated when empty.
+	SessionID string
+
+	// Lazy defers dialing until Scraper.Connect is called. Run blocks without
+	// connecting until then.
+	Lazy bool
+
+	// Transform is applied to every received record before it is delivered,
+	// e.g. to trim large fields. It receives a *tipb.TopSQLSubResponse or a
+	// *resource_usage_agent.ResourceUsageRecord and returns the record to
+	// deliver in its place, which may be the argument itself, or nil to drop
+	// it. Dropped records are counted in Stats.
+	Transform func(record interface{}) interface{}
+	// HeartbeatInterval enables heartbeat records, passed to Handler when the
+	// target is subscribed but no record has been received for this long,
+	// and then again every interval while it stays silent. Records are not
+	// queued for RecvInto. Zero disables heartbeats.
+	HeartbeatInterval time.Duration
+	// SnapshotComplete recognizes the record completing the initial snapshot
+	// of a stream, for servers sending the full state on subscription before
+	// incremental updates. Records of every stream up to and including the
+	// one it returns true for are flagged ScrapedRecord.Snapshot. It is
+	// called with the raw record, like Transform, and sees both kinds of
+	// records of a target of both TiDB and TiKV data, whose streams share one
+	// snapshot. Nil, the default, flags no record, as neither TiDB nor TiKV
+	// sends a snapshot so far. FirstRecordSnapshot flags the first record of
+	// every stream.
+	SnapshotComplete func(record interface{}) bool
+	// Handler receives every scraped record. Records are discarded when nil.
+	Handler RecordHandler
+	// RecordSink receives the raw message of every scraped record before
+	// Handler, from the scrape goroutine and after the middlewares. It is
+	// never called after Close returns, as Close waits for a call in
+	// progress, so the sink must not close the scraper itself. Records are
+	// only counted when both are nil.
+	RecordSink RecordSink
+	// Middlewares wrap Handler, with the first being the outermost.
+	Middlewares []Middleware
+	// Tee receives a copy of every delivered record before it is passed to
+	// Handler, e.g. for a live view. The copy shares the messages with the
+	// original, so it must not be modified, nor used after the record is
+	// released when PoolRecords is enabled. TeePolicy decides what to do
+	// when the channel is full.
+	Tee       chan<- ScrapedRecord
+	TeePolicy TeePolicy
+	// QueueSize enables consuming records via Scraper.RecvInto or Records,
+	// queueing up to this many records. The scrape loop blocks while the
+	// queue is full, unless QueueDrop is set, which drops records not fitting
+	// into the queue instead, counting them in Stats.QueueDropped, so that a
+	// lagging consumer does not stall receiving. Dropped records are
+	// released, see ScrapedRecord.Release.
+	QueueSize int
+	QueueDrop bool
+	// MetaCacheSize enables resolving the digests of TiDB records via
+	// Scraper.LookupSQL and LookupPlan, keeping the text of up to this many
+	// SQL and plan digests each, see MetaResolver.
+	MetaCacheSize int
+	// PoolRecords reuses the messages of records on which ScrapedRecord.Release
+	// has been called, reducing allocations for busy targets. See Release for
+	// the contract consumers must follow.
+	PoolRecords bool
+	// MaxRecords stops the scraper once this many records have been delivered
+	// to Handler, counting across reconnects. Zero means no limit.
+	MaxRecords uint64
+	// MaxDuration stops the scraper once it has been scraping for this long,
+	// regardless of the parent context. Records already queued are still
+	// received by RecvInto. Zero means no limit.
+	MaxDuration time.Duration
+	// StopOnHandlerPanic stops the scraper when Handler panics. Otherwise the
+	// panic is logged and scraping continues with the next record.
+	StopOnHandlerPanic bool
+
+	// SubscribeContext derives the context of every Subscribe call from the
+	// scraper context, e.g. to attach outgoing metadata. A deadline set on it
+	// ends the stream, which is then re-established as usual.
+	SubscribeContext func(parent context.Context) context.Context
+
+	// OnConnect and OnDisconnect are invoked when a connection to the target
+	// is established or torn down, without holding any scraper lock. The
+	// error passed to OnDisconnect is the cause, or nil for a deliberate close.
+	OnConnect    func(utils.Component)
+	OnDisconnect func(utils.Component, error)
+	// OnStateChange is invoked when the scraper becomes connected, i.e. a
+	// dial succeeds, or disconnected, i.e. the connection is torn down or a
+	// dial fails, with the cause or nil for a deliberate close. Unlike
+	// OnConnect and OnDisconnect, it is invoked once per transition rather
+	// than per connection or retry, e.g. to alert on a target that cannot be
+	// reached. It is invoked without holding any scraper lock.
+	OnStateChange func(component utils.Component, connected bool, err error)
+	// OnHeader is invoked with the header metadata of every subscribed
+	// stream, and OnTrailer with the trailer metadata of every failed one,
+	// e.g. to read diagnostics added by the server. For a target of both
+	// TiDB and TiKV data, only the header of the stream sending the first
+	// record and the trailer of the stream failing first are passed.
+	OnHeader  func(utils.Component, metadata.MD)
+	OnTrailer func(utils.Component, metadata.MD)
+
+	// Conn is an already established connection to scrape over instead of
+	// dialing the target address. It can be used only once, so the scraper
+	// is not able to reconnect after it is broken.
+	Conn net.Conn
+	// ContextDialer replaces the default TCP dialer, e.g. to connect through
+	// a proxy or an in-memory listener. It is ignored when Conn is set.
+	ContextDialer func(ctx context.Context, addr string) (net.Conn, error)
+	// ClientConnFactory replaces dialing altogether, returning the client
+	// connection to the address, e.g. one set up for a proxy or a test. It
+	// is called with a context bounded by DialTimeout on every connect, and
+	// the connection is closed on reconnect like a dialed one, unless
+	// SharedClientConn is set, e.g. as it is shared by many scrapers, in which
+	// case it is left to the factory. As the factory builds the connection,
+	// Conn, ContextDialer, TLS, keepalive, balancing and the other dial
+	// options are ignored, while the ones of Subscribe calls are not.
+	ClientConnFactory func(ctx context.Context, addr string) (*grpc.ClientConn, error)
+	SharedClientConn  bool
+
+	// UnaryInterceptors and StreamInterceptors are chained into the client
+	// connection, e.g. to plug in existing gRPC middleware. Subscribe is a
+	// streaming call, so it only passes through StreamInterceptors.
+	UnaryInterceptors  []grpc.UnaryClientInterceptor
+	StreamInterceptors []grpc.StreamClientInterceptor
+
+	// Clock drives the timing of the scraper, i.e. backoff waits, timeouts,
+	// heartbeats and the receive times of records, e.g. to be replaced by a
+	// fake clock in tests. Defaults to utils.RealClock.
+	Clock utils.Clock
+
+	// dialLimiter is a semaphore shared by scrapers of a pool, limiting the
+	// number of concurrent dials.
+	dialLimiter chan struct{}
+	// budget is the memory budget shared by scrapers of a pool.
+	budget *memoryBudget
+}
+
+// DefaultConfigFor returns the default configuration for scraping the given
+// kind of component.
+func DefaultConfigFor(kind utils.ComponentKind) ScraperConfig {
+	cfg := ScraperConfig{
+		DialTimeout:          5 * time.Second,
+		KeepaliveTime:        10 * time.Second,
+		KeepaliveTimeout:     3 * time.Second,
+		ConnectBackoff:       connectBackoff,
+		MaxRecvMsgSize:       4 * 1024 * 1024,
+		FirstWaitTime:        2 * time.Second,
+		MaxRetryTimes:        8,
+		MinReconnectInterval: 200 * time.Millisecond,
+		DegradedThreshold:    time.Minute,
+		RetryLogLevel:        zapcore.WarnLevel,
+		RecordLogLevel:       zapcore.InfoLevel,
+		LoadBalancingPolicy:  LoadBalancingPickFirst,
+		FastRateWindow:       5 * time.Second,
+		SlowRateWindow:       time.Minute,
+		ClockSkewThreshold:   2 * time.Minute,
+		Clock:                utils.RealClock,
+		UserAgent:            DefaultUserAgent,
+	}
+
+	switch kind {
+	case utils.ComponentTiDB:
+		// SQL and plan metas are sent along with records and a single
+		// normalized SQL or plan may be larger than 1MB.
+		cfg.MaxRecvMsgSize = 16 * 1024 * 1024
+	case utils.ComponentTiKV, utils.ComponentTiFlash, utils.ComponentTiDBTiKV:
+		// TiKV reports all resource groups of a window at once, so records
+		// come in bursts and can be much larger than TiDB ones.
+		cfg.MaxRecvMsgSize = 32 * 1024 * 1024
+		cfg.KeepaliveTime = 30 * time.Second
+	}
+
+	return cfg
+}
+
+type Option func(*ScraperConfig)
+
+// WithConfig replaces the whole configuration. Options after it still apply.
+// Fields left zero are not filled from the defaults, so config should start
+// from DefaultConfigFor; Run rejects a config without a max receive message
+// size, first wait time or connect backoff.
+func WithConfig(config ScraperConfig) Option {
+	return func(cfg *ScraperConfig) {
+		*cfg = config
+	}
+}
+
+func WithLoadBalancingPolicy(policy string) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.LoadBalancingPolicy = policy
+	}
+}
+
+func WithConn(conn net.Conn) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.Conn = conn
+	}
+}
+
+func WithHandler(handler RecordHandler) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.Handler = handler
+	}
+}
+
+func WithSQLDigestFilter(allowlist []string) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.SQLDigestAllowlist = allowlist
+	}
+}
+
+func WithDedupWindow(window time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.DedupWindow = window
+	}
+}
+
+func WithResourceGroupFilter(allowlist, denylist []string) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.ResourceGroupAllowlist = allowlist
+		cfg.ResourceGroupDenylist = denylist
+	}
+}
+
+func OnConnect(f func(utils.Component)) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.OnConnect = f
+	}
+}
+
+func OnHeader(f func(utils.Component, metadata.MD)) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.OnHeader = f
+	}
+}
+
+func OnTrailer(f func(utils.Component, metadata.MD)) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.OnTrailer = f
+	}
+}
+
+func OnDisconnect(f func(utils.Component, error)) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.OnDisconnect = f
+	}
+}
+
+func OnStateChange(f func(component utils.Component, connected bool, err error)) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.OnStateChange = f
+	}
+}
+
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.DialTimeout = timeout
+	}
+}
+
+func WithKeepalive(time, timeout time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.KeepaliveTime = time
+		cfg.KeepaliveTimeout = timeout
+	}
+}
+
+func WithFailoverAddrs(addrs ...string) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.FailoverAddrs = addrs
+	}
+}
+
+func WithCompressor(name string) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.Compressor = name
+	}
+}
+
+func WithConnectBackoff(config backoff.Config) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.ConnectBackoff = config
+	}
+}
+
+func WithMinReconnectInterval(interval time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.MinReconnectInterval = interval
+	}
+}
+
+func WithRateWindows(fast, slow time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.FastRateWindow = fast
+		cfg.SlowRateWindow = slow
+	}
+}
+
+func WithMaxStreamLifetime(lifetime time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.MaxStreamLifetime = lifetime
+	}
+}
+
+// WithPolling selects ModePolling, subscribing every interval for window.
+func WithPolling(interval, window time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.Mode = ModePolling
+		cfg.PollInterval = interval
+		cfg.PollWindow = window
+	}
+}
+
+func WithRecvTimeout(timeout time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.RecvTimeout = timeout
+	}
+}
+
+func WithStopOnHandlerPanic(stop bool) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.StopOnHandlerPanic = stop
+	}
+}
+
+func WithMaxRecords(n uint64) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.MaxRecords = n
+	}
+}
+
+func WithMaxDuration(d time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.MaxDuration = d
+	}
+}
+
+func WithSubscribeContext(f func(parent context.Context) context.Context) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.SubscribeContext = f
+	}
+}
+
+func WithPoolRecords(pool bool) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.PoolRecords = pool
+	}
+}
+
+func WithLazy(lazy bool) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.Lazy = lazy
+	}
+}
+
+func WithSessionID(id string) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.SessionID = id
+	}
+}
+
+func WithAdaptiveBackoff(adaptive bool) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.AdaptiveBackoff = adaptive
+	}
+}
+
+func WithRetryLogLevel(level zapcore.Level) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.RetryLogLevel = level
+	}
+}
+
+func WithFailureLogInterval(interval time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.FailureLogInterval = interval
+	}
+}
+
+func WithRecordLogLevel(level zapcore.Level) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.RecordLogLevel = level
+	}
+}
+
+func WithQueueSize(size int) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.QueueSize = size
+	}
+}
+
+func WithMetaCache(size int) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.MetaCacheSize = size
+	}
+}
+
+func WithQueueDrop(drop bool) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.QueueDrop = drop
+	}
+}
+
+func WithContextDialer(dialer func(ctx context.Context, addr string) (net.Conn, error)) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.ContextDialer = dialer
+	}
+}
+
+func WithClientConnFactory(factory func(ctx context.Context, addr string) (*grpc.ClientConn, error), shared bool) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.ClientConnFactory = factory
+		cfg.SharedClientConn = shared
+	}
+}
+
+func WithUnaryInterceptors(interceptors ...grpc.UnaryClientInterceptor) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.UnaryInterceptors = append(cfg.UnaryInterceptors, interceptors...)
+	}
+}
+
+func WithStreamInterceptors(interceptors ...grpc.StreamClientInterceptor) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.StreamInterceptors = append(cfg.StreamInterceptors, interceptors...)
+	}
+}
+
+func WithClock(clock utils.Clock) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.Clock = clock
+	}
+}
+
+func WithClockSkewThreshold(threshold time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.ClockSkewThreshold = threshold
+	}
+}
+
+func WithRetry(firstWaitTime time.Duration, maxDialRetryTimes, maxSubscribeRetryTimes uint) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.FirstWaitTime = firstWaitTime
+		cfg.MaxRetryTimes = maxDialRetryTimes
+		cfg.MaxSubscribeRetryTimes = maxSubscribeRetryTimes
+	}
+}
+
+func WithReconnectOnStreamClose(reconnect bool) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.ReconnectOnStreamClose = reconnect
+	}
+}
+
+func WithRetryPolicy(policy func(codes.Code) RetryDecision) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.RetryPolicy = policy
+	}
+}
+
+func WithTransform(transform func(record interface{}) interface{}) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.Transform = transform
+	}
+}
+
+func WithMiddlewares(middlewares ...Middleware) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.Middlewares = append(cfg.Middlewares, middlewares...)
+	}
+}
+
+func WithDegradedThreshold(threshold time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.DegradedThreshold = threshold
+	}
+}
+
+// FirstRecordSnapshot is a ScraperConfig.SnapshotComplete treating the first
+// record of every stream as its snapshot.
+func FirstRecordSnapshot(interface{}) bool {
+	return true
+}
+
+func WithSnapshotComplete(f func(record interface{}) bool) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.SnapshotComplete = f
+	}
+}
+
+func WithRecordSink(sink RecordSink) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.RecordSink = sink
+	}
+}
+
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.HeartbeatInterval = interval
+	}
+}
+
+func WithTee(ch chan<- ScrapedRecord, policy TeePolicy) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.Tee = ch
+		cfg.TeePolicy = policy
+	}
+}
+
+func WithServiceConfig(config string) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.ServiceConfig = config
+	}
+}
+
+func WithUserAgent(userAgent string) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.UserAgent = userAgent
+	}
+}
+
+func WithFirstRecvRetryTimes(n uint) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.FirstRecvRetryTimes = n
+	}
+}
+
+func WithStartupGracePeriod(period time.Duration) Option {
+	return func(cfg *ScraperConfig) {
+		cfg.StartupGracePeriod = period
+	}
+}
+
+// DialSettings are the effective parameters of connections to a target.
+type DialSettings struct {
+	// Target is the gRPC target dialed, which differs from the address when
+	// it is resolved via DNS for load balancing.
+	Target           string
+	DialTimeout      time.Duration
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// Backoff is the backoff of gRPC between connection attempts within a
+	// single dial, as opposed to the retries of the scraper.
+	Backoff        backoff.Config
+	MaxRecvMsgSize int
+	TLS            bool
+	// ServiceConfig is the default service config, empty if none.
+	ServiceConfig string
+	UserAgent     string
+	// Compressor is the compressor Subscribe streams are compressed with,
+	// empty if none or if the target rejected it.
+	Compressor string
+	// CustomDialer reports whether ScraperConfig.Conn, ContextDialer or
+	// ClientConnFactory replaces the default TCP dialer.
+	CustomDialer       bool
+	UnaryInterceptors  int
+	StreamInterceptors int
+}
+
+// DialSettings returns the parameters the scraper dials its target with, to
+// confirm what overrides took effect.
+func (s *Scraper) DialSettings() DialSettings {
+	s.bo.updateMu.Lock()
+	dialTimeout, keepaliveTime, keepaliveTimeout := s.bo.cfg.DialTimeout, s.bo.cfg.KeepaliveTime, s.bo.cfg.KeepaliveTimeout
+	s.bo.updateMu.Unlock()
+	return DialSettings{
+		Target:             dialTarget(s.bo.currentAddr(), s.cfg),
+		DialTimeout:        dialTimeout,
+		KeepaliveTime:      keepaliveTime,
+		KeepaliveTimeout:   keepaliveTimeout,
+		Backoff:            s.cfg.ConnectBackoff,
+		MaxRecvMsgSize:     s.cfg.MaxRecvMsgSize,
+		TLS:                s.bo.tlsConfig() != nil,
+		ServiceConfig:      serviceConfig(s.cfg),
+		UserAgent:          s.cfg.UserAgent,
+		Compressor:         s.bo.compressor(),
+		CustomDialer:       s.cfg.Conn != nil || s.cfg.ContextDialer != nil || s.cfg.ClientConnFactory != nil,
+		UnaryInterceptors:  len(s.cfg.UnaryInterceptors),
+		StreamInterceptors: len(s.cfg.StreamInterceptors),
+	}
+}
@@ -0,0 +1,134 @@
+package topsql
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// csvColumns are the columns a CSVSink can write, by name. A column is
+// written empty when the record has no such field, e.g. exec_count of TiKV
+// records.
+var csvColumns = map[string]func(record ScrapedRecord, timestampSec uint64, stat DigestStat) string{
+	"timestamp": func(_ ScrapedRecord, ts uint64, _ DigestStat) string {
+		return time.Unix(int64(ts), 0).UTC().Format(time.RFC3339)
+	},
+	"received_at": func(r ScrapedRecord, _ uint64, _ DigestStat) string {
+		return r.ReceivedAt.UTC().Format(time.RFC3339Nano)
+	},
+	"component": func(r ScrapedRecord, _ uint64, _ DigestStat) string {
+		return r.Component.String()
+	},
+	"kind": func(r ScrapedRecord, _ uint64, _ DigestStat) string {
+		return string(r.Component.Kind)
+	},
+	"addr": func(r ScrapedRecord, _ uint64, _ DigestStat) string {
+		return r.Component.Addr
+	},
+	"session": func(r ScrapedRecord, _ uint64, _ DigestStat) string {
+		return r.SessionID
+	},
+	"sql_digest": func(_ ScrapedRecord, _ uint64, d DigestStat) string {
+		return hex.EncodeToString(d.SQLDigest)
+	},
+	"plan_digest": func(_ ScrapedRecord, _ uint64, d DigestStat) string {
+		return hex.EncodeToString(d.PlanDigest)
+	},
+	"cpu_time_ms": func(_ ScrapedRecord, _ uint64, d DigestStat) string {
+		return strconv.FormatUint(d.CPUTimeMs, 10)
+	},
+	"exec_count": func(r ScrapedRecord, _ uint64, d DigestStat) string {
+		if r.TiDB == nil {
+			return ""
+		}
+		return strconv.FormatUint(d.ExecCount, 10)
+	},
+	"read_keys": func(r ScrapedRecord, _ uint64, d DigestStat) string {
+		if r.TiKV == nil {
+			return ""
+		}
+		return strconv.FormatUint(d.ReadKeys, 10)
+	},
+	"write_keys": func(r ScrapedRecord, _ uint64, d DigestStat) string {
+		if r.TiKV == nil {
+			return ""
+		}
+		return strconv.FormatUint(d.WriteKeys, 10)
+	},
+}
+
+// DefaultCSVColumns are the columns written by a CSVSink when none are given.
+var DefaultCSVColumns = []string{"timestamp", "component", "sql_digest", "plan_digest", "cpu_time_ms", "exec_count", "read_keys", "write_keys"}
+
+// CSVSink writes records as CSV, one row per data point, after a header row
+// of the column names. Records without data points, e.g. SQL and plan metas
+// and heartbeats, are skipped. It is safe for concurrent use.
+type CSVSink struct {
+	columns []func(ScrapedRecord, uint64, DigestStat) string
+
+	mu  sync.Mutex
+	w   *csv.Writer
+	row []string
+}
+
+// NewCSVSink creates a sink writing the given columns, or DefaultCSVColumns
+// if none, to w, and writes the header row. The available columns are
+// timestamp, received_at, component, kind, addr, session, sql_digest,
+// plan_digest, cpu_time_ms, exec_count, read_keys and write_keys. Digests are
+// written in hex.
+func NewCSVSink(w io.Writer, columns ...string) (*CSVSink, error) {
+	if len(columns) == 0 {
+		columns = DefaultCSVColumns
+	}
+	s := &CSVSink{
+		w:   csv.NewWriter(w),
+		row: make([]string, len(columns)),
+	}
+	for _, name := range columns {
+		column, ok := csvColumns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		s.columns = append(s.columns, column)
+	}
+	if err := s.w.Write(columns); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+var _ Sink = (*CSVSink)(nil)
+
+func (s *CSVSink) Write(record ScrapedRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	forEachDataPoint(record, func(timestampSec uint64, stat DigestStat) {
+		if err != nil {
+			return
+		}
+		for i, column := range s.columns {
+			s.row[i] = column(record, timestampSec, stat)
+		}
+		err = s.w.Write(s.row)
+	})
+	return err
+}
+
+// Flush writes buffered rows to the underlying writer.
+func (s *CSVSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// Close flushes the sink. The underlying writer is not closed.
+func (s *CSVSink) Close() error {
+	return s.Flush()
+}
@@ -0,0 +1,94 @@
+package topsql
+
+import "time"
+
+// recordDedup remembers the data points received within the last window of
+// timestamps, to drop the records replayed by the target after a reconnect.
+// Each scraper has its own, so the component is implied by the set. It is
+// used by the scrape goroutine only.
+type recordDedup struct {
+	window uint64 // seconds
+	seen   map[dedupKey]struct{}
+	latest uint64 // latest timestamp seen
+	pruned uint64 // latest when last pruned
+}
+
+// dedupKey identifies a data point. For TiKV records, sql holds the raw
+// resource group tag, which also tells apart the labels of the same digests,
+// and plan is empty.
+type dedupKey struct {
+	sql  string
+	plan string
+	ts   uint64
+}
+
+func newRecordDedup(window time.Duration) *recordDedup {
+	if window <= 0 {
+		return nil
+	}
+	return &recordDedup{
+		// Rounded up to whole seconds, the unit of timestamps.
+		window: uint64((window + time.Second - 1) / time.Second),
+		seen:   make(map[dedupKey]struct{}),
+	}
+}
+
+// duplicate reports whether every data point of the record was seen before,
+// remembering the ones that were not. A record replaying only some of them is
+// not a duplicate and is kept whole. Records without data points, e.g. metas,
+// are never duplicates.
+func (d *recordDedup) duplicate(record ScrapedRecord) bool {
+	if d == nil {
+		return false
+	}
+	var sql, plan string
+	var timestamps []uint64
+	switch {
+	case record.TiDB.GetRecord() != nil:
+		r := record.TiDB.GetRecord()
+		sql, plan = string(r.SqlDigest), string(r.PlanDigest)
+		for _, item := range r.Items {
+			timestamps = append(timestamps, item.TimestampSec)
+		}
+	case record.TiKV.GetRecord() != nil:
+		r := record.TiKV.GetRecord()
+		sql = string(r.ResourceGroupTag)
+		for _, item := range r.Items {
+			timestamps = append(timestamps, item.TimestampSec)
+		}
+	default:
+		return false
+	}
+	if len(timestamps) == 0 {
+		return false
+	}
+
+	fresh := false
+	for _, ts := range timestamps {
+		key := dedupKey{sql: sql, plan: plan, ts: ts}
+		if _, ok := d.seen[key]; !ok {
+			d.seen[key] = struct{}{}
+			fresh = true
+		}
+		if ts > d.latest {
+			d.latest = ts
+		}
+	}
+	d.prune()
+	return !fresh
+}
+
+// prune forgets the data points older than the window before the latest
+// timestamp. It scans the set once the latest timestamp has advanced by half
+// a window, so that the cost is amortized over the records in between.
+func (d *recordDedup) prune() {
+	if d.latest < d.pruned+(d.window+1)/2 {
+		return
+	}
+	d.pruned = d.latest
+	for key := range d.seen {
+		if key.ts+d.window < d.latest {
+			delete(d.seen, key)
+		}
+	}
+}
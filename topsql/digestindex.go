@@ -0,0 +1,82 @@
+package topsql
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DigestInfo is a SQL digest seen by a DigestIndex.
+type DigestInfo struct {
+	SQLDigest []byte
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Count is the number of data points of the digest.
+	Count uint64
+}
+
+// DigestIndex keeps an inventory of the distinct SQL digests in the records
+// it handles, e.g. of a single scraper to tell what is running on its target.
+// The seen times are the timestamps of the data points. Once more than max
+// digests are seen, the least recently seen one is evicted.
+type DigestIndex struct {
+	max int
+
+	mu      sync.Mutex
+	digests map[string]*list.Element // of *DigestInfo
+	lru     list.List                // most recently seen first
+}
+
+func NewDigestIndex(max int) *DigestIndex {
+	return &DigestIndex{
+		max:     max,
+		digests: make(map[string]*list.Element),
+	}
+}
+
+// Handle is a RecordHandler adding the digests of the record to the index.
+func (x *DigestIndex) Handle(record ScrapedRecord) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	forEachDataPoint(record, func(timestampSec uint64, stat DigestStat) {
+		ts := time.Unix(int64(timestampSec), 0)
+		if e, ok := x.digests[string(stat.SQLDigest)]; ok {
+			info := e.Value.(*DigestInfo)
+			if ts.Before(info.FirstSeen) {
+				info.FirstSeen = ts
+			}
+			if ts.After(info.LastSeen) {
+				info.LastSeen = ts
+			}
+			info.Count++
+			x.lru.MoveToFront(e)
+			return
+		}
+
+		info := &DigestInfo{
+			SQLDigest: append([]byte(nil), stat.SQLDigest...),
+			FirstSeen: ts,
+			LastSeen:  ts,
+			Count:     1,
+		}
+		x.digests[string(stat.SQLDigest)] = x.lru.PushFront(info)
+		if x.lru.Len() > x.max {
+			oldest := x.lru.Remove(x.lru.Back()).(*DigestInfo)
+			delete(x.digests, string(oldest.SQLDigest))
+		}
+	})
+	return nil
+}
+
+// Digests returns the digests in the index, most recently seen first.
+func (x *DigestIndex) Digests() []DigestInfo {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	digests := make([]DigestInfo, 0, x.lru.Len())
+	for e := x.lru.Front(); e != nil; e = e.Next() {
+		digests = append(digests, *e.Value.(*DigestInfo))
+	}
+	return digests
+}
@@ -0,0 +1,214 @@
+package topsql
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type FlushPolicy int
+
+const (
+	// FlushPerRecord writes and fsyncs every record before Handle returns, so
+	// no handled record is lost on a crash, at the cost of throughput.
+	FlushPerRecord FlushPolicy = iota
+	// FlushEveryN fsyncs after every FileSinkConfig.N records. Up to N-1
+	// records may be lost on a crash.
+	FlushEveryN
+	// FlushInterval fsyncs every FileSinkConfig.Interval. Records handled
+	// during the last interval may be lost on a crash.
+	FlushInterval
+)
+
+type FileSinkConfig struct {
+	Policy   FlushPolicy
+	N        int
+	Interval time.Duration
+	// MaxSize rolls the file over once writing a record would grow it beyond
+	// this many bytes: the file is renamed to path.1, an earlier path.1 to
+	// path.2 and so on, and a new file is started. Zero disables rotation.
+	// MaxBackups limits the number of rolled over files kept, removing the
+	// oldest ones. Zero keeps all of them.
+	MaxSize    int64
+	MaxBackups int
+}
+
+// FileSink appends records as lines of JSON to a file, see
+// ScrapedRecord.MarshalJSON. It is safe for concurrent use, so that a single
+// sink can be shared by many scrapers, whose records can be told apart by
+// their component.
+type FileSink struct {
+	cfg  FileSinkConfig
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	pending int
+
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func NewFileSink(path string, cfg FileSinkConfig) (*FileSink, error) {
+	s := &FileSink{
+		cfg:  cfg,
+		path: path,
+		stop: make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if cfg.Policy == FlushInterval && cfg.Interval > 0 {
+		s.wg.Add(1)
+		go s.flushLoop()
+	}
+	return s, nil
+}
+
+// Handle is a RecordHandler writing the record to the file, same as Write.
+func (s *FileSink) Handle(record ScrapedRecord) error {
+	return s.Write(record)
+}
+
+// Write writes the record to the file, flushing it according to the policy.
+func (s *FileSink) Write(record ScrapedRecord) error {
+	line, err := record.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cfg.MaxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.cfg.MaxSize {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := s.w.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	s.pending++
+
+	switch s.cfg.Policy {
+	case FlushPerRecord:
+		return s.flushLocked()
+	case FlushEveryN:
+		if s.pending >= s.cfg.N {
+			return s.flushLocked()
+		}
+	}
+	return nil
+}
+
+// Flush writes all buffered records to the file and fsyncs it.
+func (s *FileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked()
+}
+
+func (s *FileSink) flushLocked() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	s.pending = 0
+	return s.file.Sync()
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.file, s.w, s.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+// rotateLocked rolls the file over. If that fails, writing goes on to the
+// current file.
+func (s *FileSink) rotateLocked() error {
+	if err := s.flushLocked(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	err := s.shiftFiles()
+	if openErr := s.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// shiftFiles renames the file to path.1, shifting the ones rolled over
+// before.
+func (s *FileSink) shiftFiles() error {
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", s.path, i) }
+	last := 0
+	for {
+		if _, err := os.Stat(backup(last + 1)); err != nil {
+			break
+		}
+		last++
+	}
+	for i := last; i >= 1; i-- {
+		var err error
+		if s.cfg.MaxBackups > 0 && i >= s.cfg.MaxBackups {
+			err = os.Remove(backup(i))
+		} else {
+			err = os.Rename(backup(i), backup(i+1))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(s.path, backup(1))
+}
+
+func (s *FileSink) flushLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = s.Flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close flushes all buffered records and closes the file. Closing again is
+// a no-op returning the error of the first Close.
+func (s *FileSink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.wg.Wait()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.closeErr = s.flushLocked()
+		if err := s.file.Close(); s.closeErr == nil {
+			s.closeErr = err
+		}
+	})
+	return s.closeErr
+}
@@ -0,0 +1,141 @@
+package topsql
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tipb/go-tipb"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+func testRecord() ScrapedRecord {
+	return ScrapedRecord{
+		Component: utils.Component{Kind: utils.ComponentTiDB, Addr: "127.0.0.1:10080"},
+		TiDB: &tipb.TopSQLSubResponse{
+			RespOneof: &tipb.TopSQLSubResponse_Record{
+				Record: &tipb.TopSQLRecord{
+					SqlDigest: []byte("sql"),
+					Items:     []*tipb.TopSQLRecordItem{{TimestampSec: 1, CpuTimeMs: 10}},
+				},
+			},
+		},
+	}
+}
+
+// linesOnDisk returns the number of records in the file, as it would be found
+// after a crash, i.e. without what is still buffered by the sink.
+func linesOnDisk(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestFileSinkFlushPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  FileSinkConfig
+		// onDisk is the number of records on disk after each of 4 writes.
+		onDisk []int
+	}{
+		{"per record", FileSinkConfig{Policy: FlushPerRecord}, []int{1, 2, 3, 4}},
+		{"every n", FileSinkConfig{Policy: FlushEveryN, N: 3}, []int{0, 0, 3, 3}},
+		{"interval", FileSinkConfig{Policy: FlushInterval, Interval: time.Hour}, []int{0, 0, 0, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "records.jsonl")
+			sink, err := NewFileSink(path, tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tc.onDisk {
+				if err := sink.Write(testRecord()); err != nil {
+					t.Fatal(err)
+				}
+				if got := linesOnDisk(t, path); got != want {
+					t.Errorf("%d records on disk after %d writes, want %d", got, i+1, want)
+				}
+			}
+			// Close flushes whatever is still buffered.
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := linesOnDisk(t, path); got != len(tc.onDisk) {
+				t.Errorf("%d records on disk after Close, want %d", got, len(tc.onDisk))
+			}
+			if err := sink.Close(); err != nil {
+				t.Errorf("second Close = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestFileSinkFlushInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	sink, err := NewFileSink(path, FileSinkConfig{Policy: FlushInterval, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Write(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for linesOnDisk(t, path) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the record was not flushed within the interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestFileSinkCrash writes records in a subprocess that exits without closing
+// the sink, as if it crashed mid-write, and counts the records that survived.
+func TestFileSinkCrash(t *testing.T) {
+	if path := os.Getenv("FILESINK_CRASH_PATH"); path != "" {
+		policy, _ := strconv.Atoi(os.Getenv("FILESINK_CRASH_POLICY"))
+		sink, err := NewFileSink(path, FileSinkConfig{Policy: FlushPolicy(policy), N: 3, Interval: time.Hour})
+		if err != nil {
+			os.Exit(1)
+		}
+		for i := 0; i < 4; i++ {
+			if err := sink.Write(testRecord()); err != nil {
+				os.Exit(1)
+			}
+		}
+		os.Exit(2)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		policy FlushPolicy
+		want   int
+	}{
+		{"per record", FlushPerRecord, 4},
+		{"every n", FlushEveryN, 3},
+		{"interval", FlushInterval, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "records.jsonl")
+			cmd := exec.Command(os.Args[0], "-test.run=^TestFileSinkCrash$")
+			cmd.Env = append(os.Environ(),
+				"FILESINK_CRASH_PATH="+path,
+				"FILESINK_CRASH_POLICY="+strconv.Itoa(int(tc.policy)))
+			err := cmd.Run()
+			if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 2 {
+				t.Fatalf("the writer exited with %v, want exit status 2", err)
+			}
+			if got := linesOnDisk(t, path); got != tc.want {
+				t.Errorf("%d records on disk after the crash, want %d", got, tc.want)
+			}
+		})
+	}
+}
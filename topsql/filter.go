@@ -0,0 +1,131 @@
+package topsql
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// resourceGroupFilter matches TiKV records by the SQL digest or the label
+// decoded from their resource group tag.
+type resourceGroupFilter struct {
+	allow *tagSet
+	deny  *tagSet
+}
+
+// tagSet holds the SQL digests, decoded from hex, and the label names, e.g.
+// ResourceGroupTagLabelRow, of a resource group filter list.
+type tagSet struct {
+	digests map[string]struct{}
+	labels  map[tipb.ResourceGroupTagLabel]struct{}
+}
+
+func newResourceGroupFilter(allow, deny []string) *resourceGroupFilter {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	return &resourceGroupFilter{
+		allow: newTagSet(allow),
+		deny:  newTagSet(deny),
+	}
+}
+
+// newTagSet returns the set of the items, nil if there are none. Items that
+// are neither label names nor hex encoded digests are rejected by
+// Scraper.validate and skipped here.
+func newTagSet(items []string) *tagSet {
+	if len(items) == 0 {
+		return nil
+	}
+	set := &tagSet{
+		digests: make(map[string]struct{}),
+		labels:  make(map[tipb.ResourceGroupTagLabel]struct{}),
+	}
+	for _, item := range items {
+		if label, ok := tipb.ResourceGroupTagLabel_value[item]; ok {
+			set.labels[tipb.ResourceGroupTagLabel(label)] = struct{}{}
+		} else if b, err := hex.DecodeString(item); err == nil {
+			set.digests[string(b)] = struct{}{}
+		}
+	}
+	return set
+}
+
+func (s *tagSet) contains(tag *tipb.ResourceGroupTag) bool {
+	if _, ok := s.digests[string(tag.SqlDigest)]; ok {
+		return true
+	}
+	_, ok := s.labels[tag.GetLabel()]
+	return ok
+}
+
+func (f *resourceGroupFilter) match(record *resource_usage_agent.ResourceUsageRecord) bool {
+	if f == nil {
+		return true
+	}
+	var tag tipb.ResourceGroupTag
+	_ = tag.Unmarshal(record.GetRecord().GetResourceGroupTag())
+	if f.deny != nil && f.deny.contains(&tag) {
+		return false
+	}
+	if f.allow != nil {
+		return f.allow.contains(&tag)
+	}
+	return true
+}
+
+// validateResourceGroupItem checks that item is a label name or a hex encoded
+// SQL digest.
+func validateResourceGroupItem(item string) error {
+	if _, ok := tipb.ResourceGroupTagLabel_value[item]; ok {
+		return nil
+	}
+	if _, err := hex.DecodeString(item); err != nil {
+		return fmt.Errorf("invalid resource group filter item %q: neither a label name nor a hex encoded SQL digest", item)
+	}
+	return nil
+}
+
+// digestFilter matches records by the SQL digest of their data points, or of
+// their SQL meta. Plan metas carry no SQL digest and always match.
+type digestFilter struct {
+	allow map[string]struct{}
+}
+
+// newDigestFilter returns a filter of the hex encoded digests. Invalid ones
+// are rejected by Scraper.validate and skipped here.
+func newDigestFilter(allow []string) *digestFilter {
+	if len(allow) == 0 {
+		return nil
+	}
+	f := &digestFilter{allow: make(map[string]struct{}, len(allow))}
+	for _, digest := range allow {
+		if b, err := hex.DecodeString(digest); err == nil {
+			f.allow[string(b)] = struct{}{}
+		}
+	}
+	return f
+}
+
+func (f *digestFilter) match(record ScrapedRecord) bool {
+	if f == nil {
+		return true
+	}
+	var digest []byte
+	switch {
+	case record.TiDB.GetRecord() != nil:
+		digest = record.TiDB.GetRecord().SqlDigest
+	case record.TiDB.GetSqlMeta() != nil:
+		digest = record.TiDB.GetSqlMeta().SqlDigest
+	case record.TiKV.GetRecord() != nil:
+		var tag tipb.ResourceGroupTag
+		_ = tag.Unmarshal(record.TiKV.GetRecord().ResourceGroupTag)
+		digest = tag.SqlDigest
+	default:
+		return true
+	}
+	_, ok := f.allow[string(digest)]
+	return ok
+}
@@ -0,0 +1,68 @@
+package topsql
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+func tiKVRecord(t *testing.T, sqlDigest string, label tipb.ResourceGroupTagLabel) *resource_usage_agent.ResourceUsageRecord {
+	digest, err := hex.DecodeString(sqlDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := (&tipb.ResourceGroupTag{SqlDigest: digest, PlanDigest: []byte("plan"), Label: &label}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &resource_usage_agent.ResourceUsageRecord{
+		RecordOneof: &resource_usage_agent.ResourceUsageRecord_Record{
+			Record: &resource_usage_agent.GroupTagRecord{ResourceGroupTag: tag},
+		},
+	}
+}
+
+func TestResourceGroupFilter(t *testing.T) {
+	rowA := tiKVRecord(t, "aa01", tipb.ResourceGroupTagLabel_ResourceGroupTagLabelRow)
+	indexA := tiKVRecord(t, "aa01", tipb.ResourceGroupTagLabel_ResourceGroupTagLabelIndex)
+	rowB := tiKVRecord(t, "bb02", tipb.ResourceGroupTagLabel_ResourceGroupTagLabelRow)
+
+	for _, tc := range []struct {
+		name        string
+		allow, deny []string
+		want        [3]bool // rowA, indexA, rowB
+	}{
+		{name: "none", want: [3]bool{true, true, true}},
+		{name: "allow digest", allow: []string{"aa01"}, want: [3]bool{true, true, false}},
+		{name: "allow upper case digest", allow: []string{"AA01"}, want: [3]bool{true, true, false}},
+		{name: "allow label", allow: []string{"ResourceGroupTagLabelIndex"}, want: [3]bool{false, true, false}},
+		{name: "deny digest", deny: []string{"bb02"}, want: [3]bool{true, true, false}},
+		{name: "deny label", deny: []string{"ResourceGroupTagLabelRow"}, want: [3]bool{false, true, false}},
+		{name: "deny wins", allow: []string{"aa01"}, deny: []string{"ResourceGroupTagLabelIndex"}, want: [3]bool{true, false, false}},
+		{name: "allow unknown digest", allow: []string{"cc03"}, want: [3]bool{false, false, false}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newResourceGroupFilter(tc.allow, tc.deny)
+			for i, record := range []*resource_usage_agent.ResourceUsageRecord{rowA, indexA, rowB} {
+				if got := f.match(record); got != tc.want[i] {
+					t.Errorf("match(record %d) = %v, want %v", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateResourceGroupItem(t *testing.T) {
+	for _, item := range []string{"aa01", "ResourceGroupTagLabelRow", "ResourceGroupTagLabelUnknown"} {
+		if err := validateResourceGroupItem(item); err != nil {
+			t.Errorf("validateResourceGroupItem(%q) = %v, want nil", item, err)
+		}
+	}
+	for _, item := range []string{"default", "aa0", "ResourceGroupTagLabelTable"} {
+		if err := validateResourceGroupItem(item); err == nil {
+			t.Errorf("validateResourceGroupItem(%q) = nil, want an error", item)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package topsql
+
+import (
+	"fmt"
+
+	"go.uber.org/multierr"
+)
+
+// MultiHandler returns a RecordHandler passing every record to all handlers
+// in order. A handler returning an error or panicking does not prevent the
+// record from reaching the remaining handlers: panics are turned into errors,
+// and all errors are combined into the returned one.
+func MultiHandler(handlers ...RecordHandler) RecordHandler {
+	return func(record ScrapedRecord) error {
+		var errs error
+		for _, handler := range handlers {
+			errs = multierr.Append(errs, callHandler(handler, record))
+		}
+		return errs
+	}
+}
+
+func callHandler(handler RecordHandler, record ScrapedRecord) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("record handler panicked: %v", r)
+		}
+	}()
+	return handler(record)
+}
+
+// Middleware wraps a RecordHandler, e.g. to add logging, metrics or rate
+// limiting around it.
+type Middleware func(next RecordHandler) RecordHandler
+
+// Chain composes middlewares into one, with the first being the outermost,
+// i.e. the first to see every record.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next RecordHandler) RecordHandler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// wrapHandler wraps handler by the middlewares of a scraper. Middlewares see
+// records even when there is no handler.
+func wrapHandler(handler RecordHandler, middlewares []Middleware) RecordHandler {
+	if len(middlewares) == 0 {
+		return handler
+	}
+	if handler == nil {
+		handler = func(ScrapedRecord) error { return nil }
+	}
+	return Chain(middlewares...)(handler)
+}
@@ -0,0 +1,76 @@
+package topsql
+
+import (
+	"time"
+)
+
+type HealthState int
+
+const (
+	// Healthy means the scraper is subscribed to the target.
+	Healthy HealthState = iota
+	// Degraded means the scraper is connecting or reconnecting to the target,
+	// for no longer than ScraperConfig.DegradedThreshold so far.
+	Degraded
+	// Down means the scraper is closed, or has not been subscribed for longer
+	// than ScraperConfig.DegradedThreshold.
+	Down
+)
+
+func (h HealthState) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Down:
+		return "down"
+	}
+	return "unknown"
+}
+
+// Health returns the health of the scraper. Unlike IsDown, which only reports
+// whether the scraper is closed, it tells apart a scraper temporarily
+// reconnecting from a healthy one.
+func (s *Scraper) Health() HealthState {
+	if s.IsDown() {
+		return Down
+	}
+	lostAt := s.bo.streamLostAt.Load()
+	if lostAt == 0 {
+		return Healthy
+	}
+	if s.cfg.Clock.Now().Sub(time.Unix(0, lostAt)) > s.cfg.DegradedThreshold {
+		return Down
+	}
+	return Degraded
+}
+
+// Status is a snapshot of the connection of a scraper, e.g. for a readiness
+// probe.
+type Status struct {
+	// Connected reports whether the scraper is subscribed to the target.
+	Connected bool
+	// LastRecordAt is the receive time of the last record, zero if none.
+	LastRecordAt time.Time
+	// ReconnectCount is the number of times the scraper started to reconnect
+	// after losing a subscription.
+	ReconnectCount uint64
+	// LastError is the last error a dial, a subscription or a stream failed
+	// with, kept after the scraper reconnected, or nil if none did.
+	LastError error
+}
+
+// Status returns the status of the scraper. It is safe to call from any
+// goroutine.
+func (s *Scraper) Status() Status {
+	status := Status{
+		Connected:      !s.IsDown() && s.bo.streamLostAt.Load() == 0,
+		ReconnectCount: s.bo.reconnects.Load(),
+		LastError:      s.bo.lastErr.Load(),
+	}
+	if last := s.lastRecordAt.Load(); last != 0 {
+		status.LastRecordAt = time.Unix(0, last)
+	}
+	return status
+}
@@ -0,0 +1,44 @@
+package topsql
+
+import (
+	"time"
+)
+
+// heartbeat passes heartbeat records to handler while the target is
+// subscribed but silent, until stop is closed.
+func (s *Scraper) heartbeat(handler RecordHandler, stop <-chan struct{}) {
+	interval := s.cfg.HeartbeatInterval
+	var lastHeartbeat time.Time
+	wait := interval
+	for {
+		select {
+		case <-s.cfg.Clock.After(wait):
+		case <-stop:
+			return
+		}
+
+		last := time.Unix(0, s.lastRecordAt.Load())
+		if lastHeartbeat.After(last) {
+			last = lastHeartbeat
+		}
+		if s.bo.streamLostAt.Load() != 0 {
+			// Not subscribed, so the scraper is not expected to be silent
+			// because of the target, and heartbeats start over once it is.
+			last = s.cfg.Clock.Now()
+		}
+		if wait = interval - s.cfg.Clock.Now().Sub(last); wait > 0 {
+			continue
+		}
+
+		lastHeartbeat = s.cfg.Clock.Now()
+		s.handleMu.Lock()
+		s.handle(handler, ScrapedRecord{
+			Component:  s.component,
+			SessionID:  s.cfg.SessionID,
+			ReceivedAt: lastHeartbeat,
+			Heartbeat:  true,
+		})
+		s.handleMu.Unlock()
+		wait = interval
+	}
+}
@@ -0,0 +1,148 @@
+package topsql
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+// RecordQuerier is a backend of records served by the HTTP handler, e.g. a
+// Store.
+type RecordQuerier interface {
+	Components() []utils.Component
+	Query(component utils.Component, from, to time.Time) []ScrapedRecord
+}
+
+// NewHTTPHandler returns a handler serving the records of querier as JSON:
+//
+//	GET /topsql/tidb?from=&to=[&addr=]
+//	GET /topsql/tikv?from=&to=[&addr=]
+//
+// from and to bound the time records were received at, as RFC 3339 times or
+// unix seconds, and addr optionally limits the records to a single address.
+// The TiKV endpoint serves TiFlash records as well.
+func NewHTTPHandler(querier RecordQuerier) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/topsql/tidb", recordsHandler{querier: querier, tidb: true})
+	mux.Handle("/topsql/tikv", recordsHandler{querier: querier})
+	return mux
+}
+
+type recordsHandler struct {
+	querier RecordQuerier
+	tidb    bool
+}
+
+type httpRecords struct {
+	Records []httpRecord `json:"records"`
+}
+
+type httpRecord struct {
+	Component  string          `json:"component"`
+	Kind       string          `json:"kind"`
+	Addr       string          `json:"addr"`
+	ReceivedAt time.Time       `json:"received_at"`
+	SQLDigest  string          `json:"sql_digest"`
+	PlanDigest string          `json:"plan_digest"`
+	Items      []httpDataPoint `json:"items"`
+}
+
+type httpDataPoint struct {
+	TimestampSec uint64  `json:"timestamp_sec"`
+	CPUTimeMs    uint64  `json:"cpu_time_ms"`
+	ExecCount    *uint64 `json:"exec_count,omitempty"`
+	ReadKeys     *uint64 `json:"read_keys,omitempty"`
+	WriteKeys    *uint64 `json:"write_keys,omitempty"`
+}
+
+func (h recordsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	from, err := parseQueryTime(query.Get("from"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+		return
+	}
+	to, err := parseQueryTime(query.Get("to"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+		return
+	}
+	if to.Before(from) {
+		http.Error(w, "invalid time range: to is before from", http.StatusBadRequest)
+		return
+	}
+	addr := query.Get("addr")
+
+	components := h.querier.Components()
+	sort.Slice(components, func(i, j int) bool {
+		return components[i].String() < components[j].String()
+	})
+	resp := httpRecords{Records: []httpRecord{}}
+	for _, component := range components {
+		if addr != "" && component.Addr != addr {
+			continue
+		}
+		for _, record := range h.querier.Query(component, from, to) {
+			if (h.tidb && record.TiDB == nil) || (!h.tidb && record.TiKV == nil) {
+				continue
+			}
+			if rec, ok := toHTTPRecord(record); ok {
+				resp.Records = append(resp.Records, rec)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// toHTTPRecord converts a record with data points, i.e. not a SQL or plan
+// meta.
+func toHTTPRecord(record ScrapedRecord) (httpRecord, bool) {
+	rec := httpRecord{
+		Component:  record.Component.String(),
+		Kind:       string(record.Component.Kind),
+		Addr:       record.Component.Addr,
+		ReceivedAt: record.ReceivedAt,
+	}
+	forEachDataPoint(record, func(ts uint64, stat DigestStat) {
+		// The digests are the same for all data points of a record.
+		rec.SQLDigest = hex.EncodeToString(stat.SQLDigest)
+		rec.PlanDigest = hex.EncodeToString(stat.PlanDigest)
+		item := httpDataPoint{TimestampSec: ts, CPUTimeMs: stat.CPUTimeMs}
+		if record.TiDB != nil {
+			item.ExecCount = &stat.ExecCount
+		} else {
+			item.ReadKeys, item.WriteKeys = &stat.ReadKeys, &stat.WriteKeys
+		}
+		rec.Items = append(rec.Items, item)
+	})
+	return rec, len(rec.Items) > 0
+}
+
+// parseQueryTime parses an RFC 3339 time or unix seconds.
+func parseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("missing")
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor unix seconds", s)
+	}
+	return t, nil
+}
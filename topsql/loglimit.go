@@ -0,0 +1,81 @@
+package topsql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// failureLogs limits the logs of failed connection attempts across all
+// scrapers.
+var failureLogs logLimiter
+
+// SetFailureLogLimit limits the logs of failed attempts to connect to targets
+// and of dead connections, across all scrapers, to n lines per second, so
+// that an outage of many targets does not flood the logs. Zero, the default,
+// means no limit. Lines of scrapers giving up are never suppressed. The
+// number of lines suppressed within a second is logged along with the first
+// line allowed after it.
+func SetFailureLogLimit(n int) {
+	failureLogs.mu.Lock()
+	defer failureLogs.mu.Unlock()
+	failureLogs.limit = n
+}
+
+type logLimiter struct {
+	mu          sync.Mutex
+	limit       int
+	windowStart time.Time
+	lines       int
+	suppressed  int
+}
+
+// allow reports whether a line may be logged now.
+func (l *logLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(l.windowStart) >= time.Second {
+		if l.suppressed > 0 {
+			log.Warn("Suppressed Top SQL connection failure logs over the limit",
+				zap.Int("suppressed", l.suppressed),
+				zap.Int("limit_per_second", l.limit))
+		}
+		l.windowStart = now
+		l.lines = 0
+		l.suppressed = 0
+	}
+	if l.lines >= l.limit {
+		l.suppressed++
+		return false
+	}
+	l.lines++
+	return true
+}
+
+// logThrottle limits a line logged for repeated events to once per interval,
+// counting the events in between. It is not safe for concurrent use.
+type logThrottle struct {
+	interval time.Duration
+	last     time.Time
+	count    int
+}
+
+// tick counts an event at now, and reports whether to log it along with the
+// number of events since the last line, including this one. A zero interval
+// allows every line.
+func (t *logThrottle) tick(now time.Time) (int, bool) {
+	t.count++
+	if t.interval > 0 && !t.last.IsZero() && now.Sub(t.last) <= t.interval {
+		return 0, false
+	}
+	n := t.count
+	t.last, t.count = now, 0
+	return n, true
+}
@@ -0,0 +1,93 @@
+package topsql
+
+import (
+	"container/list"
+	"sync"
+)
+
+// MetaResolver maps SQL and plan digests to their normalized text, learnt
+// from the SQL and plan metas TiDB sends along with records. Once more than
+// max SQL or plan digests are known, the least recently used one is evicted.
+type MetaResolver struct {
+	sqls  *metaCache
+	plans *metaCache
+}
+
+func NewMetaResolver(max int) *MetaResolver {
+	return &MetaResolver{
+		sqls:  newMetaCache(max),
+		plans: newMetaCache(max),
+	}
+}
+
+// Handle is a RecordHandler learning the text of SQL and plan metas. Other
+// records are ignored.
+func (r *MetaResolver) Handle(record ScrapedRecord) error {
+	if meta := record.TiDB.GetSqlMeta(); meta != nil {
+		r.sqls.put(meta.SqlDigest, meta.NormalizedSql)
+	}
+	if meta := record.TiDB.GetPlanMeta(); meta != nil {
+		r.plans.put(meta.PlanDigest, meta.NormalizedPlan)
+	}
+	return nil
+}
+
+// LookupSQL returns the normalized SQL of the digest, if known.
+func (r *MetaResolver) LookupSQL(digest []byte) (string, bool) {
+	return r.sqls.get(digest)
+}
+
+// LookupPlan returns the normalized plan of the digest, if known. The plan is
+// encoded by TiDB and needs to be decoded for display.
+func (r *MetaResolver) LookupPlan(digest []byte) (string, bool) {
+	return r.plans.get(digest)
+}
+
+type metaEntry struct {
+	digest string
+	text   string
+}
+
+type metaCache struct {
+	max int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *metaEntry
+	lru     *list.List               // most recently used first
+}
+
+func newMetaCache(max int) *metaCache {
+	return &metaCache{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *metaCache) put(digest []byte, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[string(digest)]; ok {
+		e.Value.(*metaEntry).text = text
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[string(digest)] = c.lru.PushFront(&metaEntry{digest: string(digest), text: text})
+	if c.lru.Len() > c.max {
+		oldest := c.lru.Remove(c.lru.Back()).(*metaEntry)
+		delete(c.entries, oldest.digest)
+	}
+}
+
+func (c *metaCache) get(digest []byte) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[string(digest)]
+	if !ok {
+		return "", false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*metaEntry).text, true
+}
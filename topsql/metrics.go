@@ -0,0 +1,188 @@
+package topsql
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+var (
+	recordInterArrival = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "record_inter_arrival_seconds",
+		Help:      "Time between two consecutive records received on a stream from a target, excluding the first record of every stream.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14), // 0.5ms ~ 4s
+	}, []string{"kind", "addr", "name", "session"})
+
+	firstRecordLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "first_record_seconds",
+		Help:      "Time from starting to (re)connect to a target until the first record of the new stream, including backoff waits.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 17), // 1ms ~ 65s
+	}, []string{"kind", "addr", "name", "session"})
+
+	recordsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "records_received_total",
+		Help:      "Number of records received from a target.",
+	}, []string{"kind", "addr", "name", "session"})
+
+	subscribeAttemptsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "subscribe_attempts_total",
+		Help:      "Number of attempts to dial and subscribe to a target.",
+	}, []string{"kind", "addr", "name", "session"})
+
+	subscriptionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "subscriptions_total",
+		Help:      "Number of subscriptions to a target established.",
+	}, []string{"kind", "addr", "name", "session"})
+
+	dialFailuresCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "dial_failures_total",
+		Help:      "Number of failed dials to a target.",
+	}, []string{"kind", "addr", "name", "session"})
+
+	connectedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "connected",
+		Help:      "Whether a target is subscribed to, 1 if it is and 0 otherwise.",
+	}, []string{"kind", "addr", "name", "session"})
+
+	connectedEndpointGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "connected_endpoint",
+		Help:      "The address a target is connected to, out of its failover addresses, set to 1.",
+	}, []string{"kind", "addr", "name", "session", "endpoint"})
+
+	keepaliveDisconnectsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "keepalive_disconnects_total",
+		Help:      "Number of connections torn down because keepalive pings were not acknowledged.",
+	}, []string{"kind", "addr", "name", "session"})
+
+	backoffWaitGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "backoff_wait_seconds",
+		Help:      "Wait before the next retry to connect to a target, 0 when connected.",
+	}, []string{"kind", "addr", "name", "session"})
+
+	// The ack metrics are summed over all AckQueues.
+	ackInFlightGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "ack_in_flight_records",
+		Help:      "Number of records received from ack queues and not acked yet.",
+	})
+	ackLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "ack_latency_seconds",
+		Help:      "Time between a record being received from an ack queue and acked.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 18), // 0.5ms ~ 65s
+	})
+
+	scraperExitsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mockngm",
+		Subsystem: "topsql",
+		Name:      "scraper_exits_total",
+		Help:      "Number of scrapers stopped, by the reason of stopping.",
+	}, []string{"reason"})
+)
+
+// Reasons of scraperExitsCounter.
+const (
+	exitCancelled      = "cancelled"
+	exitRetryExhausted = "retry_exhausted"
+	exitMaxRecords     = "max_records"
+	exitMaxDuration    = "max_duration"
+	exitEOF            = "eof"
+	exitInvalidConfig  = "invalid_config"
+	exitAborted        = "aborted"
+)
+
+// MetricsCollectors returns the collectors of all scraper metrics, to be
+// registered to a registry by the caller.
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		recordInterArrival,
+		firstRecordLatency,
+		recordsCounter,
+		subscribeAttemptsCounter,
+		subscriptionsCounter,
+		dialFailuresCounter,
+		connectedGauge,
+		connectedEndpointGauge,
+		keepaliveDisconnectsCounter,
+		backoffWaitGauge,
+		ackInFlightGauge,
+		ackLatency,
+		scraperExitsCounter,
+	}
+}
+
+// scraperMetrics are the metrics of a scraper, resolved once as they are
+// updated often.
+type scraperMetrics struct {
+	interArrival      prometheus.Observer
+	firstRecord       prometheus.Observer
+	records           prometheus.Counter
+	subscribeAttempts prometheus.Counter
+	subscriptions     prometheus.Counter
+	dialFailures      prometheus.Counter
+	connected         prometheus.Gauge
+}
+
+func newScraperMetrics(component utils.Component, session string) *scraperMetrics {
+	labels := metricLabels(component, session)
+	return &scraperMetrics{
+		interArrival:      recordInterArrival.With(labels),
+		firstRecord:       firstRecordLatency.With(labels),
+		records:           recordsCounter.With(labels),
+		subscribeAttempts: subscribeAttemptsCounter.With(labels),
+		subscriptions:     subscriptionsCounter.With(labels),
+		dialFailures:      dialFailuresCounter.With(labels),
+		connected:         connectedGauge.With(labels),
+	}
+}
+
+// deleteScraperMetrics deletes the series of a scraper once it stopped, as
+// every session has its own and they would pile up otherwise.
+func deleteScraperMetrics(component utils.Component, session string) {
+	labels := metricLabels(component, session)
+	for _, vec := range []interface{ Delete(prometheus.Labels) bool }{
+		recordInterArrival,
+		firstRecordLatency,
+		recordsCounter,
+		subscribeAttemptsCounter,
+		subscriptionsCounter,
+		dialFailuresCounter,
+		connectedGauge,
+		keepaliveDisconnectsCounter,
+		backoffWaitGauge,
+	} {
+		vec.Delete(labels)
+	}
+}
+
+func endpointLabels(component utils.Component, session, endpoint string) prometheus.Labels {
+	labels := metricLabels(component, session)
+	labels["endpoint"] = endpoint
+	return labels
+}
+
+func metricLabels(component utils.Component, session string) prometheus.Labels {
+	return prometheus.Labels{"kind": string(component.Kind), "addr": component.Addr, "name": component.Name, "session": session}
+}
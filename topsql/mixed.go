@@ -0,0 +1,91 @@
+package topsql
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+	"google.golang.org/grpc"
+)
+
+var errMixedStreamClosed = errors.New("mixed stream closed")
+
+// mixedStream merges a TiDB and a TiKV subscription established over the
+// same connection. Records of both kinds are returned by Recv in arrival
+// order, and the first error of either stream fails the whole stream, after
+// a record already received from the other one is returned.
+type mixedStream struct {
+	streams   []grpc.ClientStream // the TiDB and the TiKV stream
+	records   chan interface{}
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	failed grpc.ClientStream // the stream failing first
+}
+
+func newMixedStream(tidb tipb.TopSQLPubSub_SubscribeClient, tikv resource_usage_agent.ResourceMeteringPubSub_SubscribeClient) *mixedStream {
+	m := &mixedStream{
+		streams: []grpc.ClientStream{tidb, tikv},
+		records: make(chan interface{}),
+		errs:    make(chan error, 2),
+		done:    make(chan struct{}),
+	}
+	go m.forward(tidb, func() (interface{}, error) { return tidb.Recv() })
+	go m.forward(tikv, func() (interface{}, error) { return tikv.Recv() })
+	return m
+}
+
+func (m *mixedStream) forward(stream grpc.ClientStream, recv func() (interface{}, error)) {
+	for {
+		record, err := recv()
+		if err != nil {
+			m.mu.Lock()
+			if m.failed == nil {
+				m.failed = stream
+			}
+			m.mu.Unlock()
+			m.errs <- err
+			return
+		}
+		select {
+		case m.records <- record:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *mixedStream) Recv() (interface{}, error) {
+	select {
+	case record := <-m.records:
+		return record, nil
+	case err := <-m.errs:
+		// The other stream may have a record received already, which would be
+		// lost once the stream is closed because of the error.
+		select {
+		case record := <-m.records:
+			m.errs <- err
+			return record, nil
+		default:
+			return nil, err
+		}
+	case <-m.done:
+		return nil, errMixedStreamClosed
+	}
+}
+
+// failedStream returns the stream failing first, if any has failed.
+func (m *mixedStream) failedStream() grpc.ClientStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failed
+}
+
+func (m *mixedStream) close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+}
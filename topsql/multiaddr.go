@@ -0,0 +1,150 @@
+package topsql
+
+import (
+	"context"
+	"crypto/tls"
+	"hash/fnv"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/multierr"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+// dedupWindow is the number of recent records remembered for deduplication.
+const dedupWindow = 4096
+
+// MultiAddrScraper scrapes several addresses of the same component at once,
+// e.g. redundant endpoints, delivering every record once regardless of how
+// many of the addresses sent it.
+//
+// Records are deduplicated by the FNV-1a hash of their marshaled message,
+// i.e. records are duplicates when they are identical byte by byte, among
+// the last 4096 distinct records. ScrapedRecord.Component of a delivered
+// record carries the address it was first received from. Only the handler,
+// with its middlewares, sees deduplicated records, and it is called from one
+// scrape goroutine at a time. Heartbeats are not passed to it, as one address
+// being silent says nothing about the others.
+type MultiAddrScraper struct {
+	scrapers []*Scraper
+
+	mu      sync.Mutex
+	handler RecordHandler
+	sink    *recordSinkHandler
+	seen    map[uint64]struct{}
+	recent  []uint64 // ring buffer of the keys in seen
+	next    int
+}
+
+func NewMultiAddrScraper(ctx context.Context, component utils.Component, addrs []string, tlsConfig *tls.Config, opts ...Option) *MultiAddrScraper {
+	cfg := DefaultConfigFor(component.Kind)
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	m := &MultiAddrScraper{
+		seen:   make(map[uint64]struct{}, dedupWindow),
+		recent: make([]uint64, 0, dedupWindow),
+	}
+	handler := cfg.Handler
+	if cfg.RecordSink != nil {
+		m.sink = &recordSinkHandler{sink: cfg.RecordSink}
+		handler = m.sink.before(handler)
+	}
+	m.handler = wrapHandler(handler, cfg.Middlewares)
+	opts = append(opts[:len(opts):len(opts)], func(cfg *ScraperConfig) {
+		cfg.Handler = m.handle
+		cfg.RecordSink = nil
+		cfg.Middlewares = nil
+	})
+	for _, addr := range addrs {
+		c := component
+		c.Addr = addr
+		m.scrapers = append(m.scrapers, NewScraper(ctx, c, tlsConfig, opts...))
+	}
+	return m
+}
+
+// Run scrapes all addresses until all scrapers stop, and returns the errors
+// they stopped with, see Scraper.Run.
+func (m *MultiAddrScraper) Run() error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs error
+	)
+	for _, s := range m.scrapers {
+		wg.Add(1)
+		go func(s *Scraper) {
+			defer wg.Done()
+			if err := s.Run(); err != nil {
+				mu.Lock()
+				errs = multierr.Append(errs, err)
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	return errs
+}
+
+// ReloadTLS replaces the TLS config of the scrapers of every address, see
+// Scraper.ReloadTLS.
+func (m *MultiAddrScraper) ReloadTLS(tlsConfig *tls.Config) {
+	for _, s := range m.scrapers {
+		s.ReloadTLS(tlsConfig)
+	}
+}
+
+func (m *MultiAddrScraper) Close() {
+	for _, s := range m.scrapers {
+		s.Close()
+	}
+	if m.sink != nil {
+		m.sink.close()
+	}
+}
+
+// Scrapers returns the scrapers of every address.
+func (m *MultiAddrScraper) Scrapers() []*Scraper {
+	return append([]*Scraper(nil), m.scrapers...)
+}
+
+func (m *MultiAddrScraper) handle(record ScrapedRecord) error {
+	if record.Heartbeat {
+		return nil
+	}
+	var msg proto.Message
+	if record.TiDB != nil {
+		msg = record.TiDB
+	} else {
+		msg = record.TiKV
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	key := h.Sum64()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.seen[key]; ok {
+		return nil
+	}
+	if len(m.recent) < dedupWindow {
+		m.recent = append(m.recent, key)
+	} else {
+		delete(m.seen, m.recent[m.next])
+		m.recent[m.next] = key
+		m.next = (m.next + 1) % dedupWindow
+	}
+	m.seen[key] = struct{}{}
+
+	if m.handler == nil {
+		return nil
+	}
+	return m.handler(record)
+}
@@ -0,0 +1,153 @@
+package topsql
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// OrderedMerger reorders records of many scrapers, e.g. all scrapers of a
+// pool, into ascending RecordTimestamp order before passing them to a single
+// handler, for consumers preferring ordered input such as time-series
+// storages. Pass Handle to the scrapers, e.g. with WithHandler in the
+// Options of a PoolConfig.
+//
+// Records are buffered for about window after they arrive, so the ordering is
+// only as good as the window is long compared to how late records of
+// different targets arrive relative to each other, and every record is
+// delayed by up to the window as the price. A record is released early once
+// records at least window newer have been received. A record arriving after
+// newer ones have already been released is out of window: it is still
+// delivered, as soon as possible and out of order, and counted by Late.
+// Records without data points, e.g. SQL and plan metas, are delivered along
+// with the records currently being released. Records of scrapers enabling
+// PoolRecords are buffered as copies, so they may be released once Handle
+// returns, while the copies passed to the handler need no release.
+type OrderedMerger struct {
+	window time.Duration
+	next   RecordHandler
+
+	mu       sync.Mutex
+	buf      orderedRecords
+	seq      uint64
+	latest   time.Time // the latest timestamp received
+	released time.Time // the latest timestamp released
+	late     atomic.Uint64
+}
+
+func NewOrderedMerger(window time.Duration, next RecordHandler) *OrderedMerger {
+	return &OrderedMerger{
+		window: window,
+		next:   next,
+	}
+}
+
+// Handle is a RecordHandler buffering the record until it is released by Run.
+func (m *OrderedMerger) Handle(record ScrapedRecord) error {
+	ts, ok := RecordTimestamp(record)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case !ok:
+		ts = m.released
+	case ts.Before(m.released):
+		m.late.Inc()
+	case ts.After(m.latest):
+		m.latest = ts
+	}
+	m.seq++
+	heap.Push(&m.buf, orderedRecord{
+		record:    record.retain(),
+		ts:        ts,
+		seq:       m.seq,
+		arrivedAt: time.Now(),
+	})
+	return nil
+}
+
+// Late returns the number of records received after newer records had been
+// released, which were delivered out of order.
+func (m *OrderedMerger) Late() uint64 {
+	return m.late.Load()
+}
+
+// Run passes released records to the handler until ctx is done. Buffered
+// records are all released in order before returning.
+func (m *OrderedMerger) Run(ctx context.Context) {
+	interval := m.window / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.flush(false)
+		case <-ctx.Done():
+			m.flush(true)
+			return
+		}
+	}
+}
+
+func (m *OrderedMerger) flush(all bool) {
+	now := time.Now()
+
+	m.mu.Lock()
+	var records []ScrapedRecord
+	for m.buf.Len() > 0 {
+		r := m.buf[0]
+		if !all && r.ts.Add(m.window).After(m.latest) && r.arrivedAt.Add(m.window).After(now) {
+			break
+		}
+		heap.Pop(&m.buf)
+		if r.ts.After(m.released) {
+			m.released = r.ts
+		}
+		records = append(records, r.record)
+	}
+	m.mu.Unlock()
+
+	for _, record := range records {
+		if err := callHandler(m.next, record); err != nil {
+			log.Warn("Failed to handle Top SQL record", zap.Stringer("target", record.Component), zap.Error(err))
+		}
+	}
+}
+
+type orderedRecord struct {
+	record    ScrapedRecord
+	ts        time.Time
+	seq       uint64 // keeps records of the same timestamp in arrival order
+	arrivedAt time.Time
+}
+
+// orderedRecords is a min-heap of records by timestamp.
+type orderedRecords []orderedRecord
+
+func (h orderedRecords) Len() int { return len(h) }
+
+func (h orderedRecords) Less(i, j int) bool {
+	if !h[i].ts.Equal(h[j].ts) {
+		return h[i].ts.Before(h[j].ts)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h orderedRecords) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *orderedRecords) Push(x interface{}) { *h = append(*h, x.(orderedRecord)) }
+
+func (h *orderedRecords) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
@@ -0,0 +1,116 @@
+package topsql
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// Pacer smooths bursts of records, e.g. the ones TiKV sends at the end of
+// every window, by buffering them and passing them to a handler at a steady
+// rate. Every buffered record is delayed by the time it takes to release the
+// records ahead of it, so a burst of n records adds up to n/rate of latency.
+//
+// Unlike rate limiting, no record is dropped: once maxBuffer records are
+// buffered, Handle blocks until one is released, which in turn stops the
+// scraper from reading its target. Use one pacer per scraper to pace targets
+// independently.
+type Pacer struct {
+	interval time.Duration // zero if unlimited
+	next     RecordHandler
+	buf      chan ScrapedRecord
+
+	// done is closed once Run has stopped, failing Handle from then on.
+	done    chan struct{}
+	mu      sync.RWMutex
+	stopped bool
+}
+
+var errPacerStopped = errors.New("pacer stopped")
+
+// NewPacer creates a pacer releasing up to rate records per second, or
+// records as soon as they are buffered if rate is not positive.
+func NewPacer(rate float64, maxBuffer int, next RecordHandler) *Pacer {
+	p := &Pacer{
+		next: next,
+		buf:  make(chan ScrapedRecord, maxBuffer),
+		done: make(chan struct{}),
+	}
+	if rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return p
+}
+
+// Handle is a RecordHandler buffering the record until it is released by Run.
+// It fails once Run has stopped, instead of blocking the scraper forever.
+func (p *Pacer) Handle(record ScrapedRecord) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		return errPacerStopped
+	}
+	select {
+	case p.buf <- record:
+		return nil
+	case <-p.done:
+		return errPacerStopped
+	}
+}
+
+// Run releases buffered records to the handler at the paced rate until ctx is
+// done, when the remaining buffered records are released at once.
+func (p *Pacer) Run(ctx context.Context) {
+	defer p.stop()
+	if p.interval <= 0 {
+		for {
+			select {
+			case record := <-p.buf:
+				p.release(record)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case record := <-p.buf:
+				p.release(record)
+			default:
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stop fails pending and later Handle calls, and releases the records
+// buffered before.
+func (p *Pacer) stop() {
+	close(p.done)
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	for {
+		select {
+		case record := <-p.buf:
+			p.release(record)
+		default:
+			return
+		}
+	}
+}
+
+func (p *Pacer) release(record ScrapedRecord) {
+	if err := callHandler(p.next, record); err != nil {
+		log.Warn("Failed to handle Top SQL record", zap.Stringer("target", record.Component), zap.Error(err))
+	}
+}
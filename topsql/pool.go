@@ -0,0 +1,570 @@
+package topsql
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+type PoolConfig struct {
+	// MaxScrapers limits the number of targets scraped at the same time. Zero
+	// means all targets are scraped.
+	MaxScrapers int
+	// Seed seeds the weighted random selection of targets, so that the
+	// selection is reproducible.
+	Seed int64
+	// MaxConcurrentDials limits the number of dials in progress at the same
+	// time across all scrapers of the pool, so that reconnects of many
+	// targets queue up instead of firing at once. Zero means no limit.
+	MaxConcurrentDials int
+	// MaxInFlightBytes approximately limits the memory used by records in
+	// flight across all scrapers of the pool, measured by their protobuf
+	// size. A record is in flight from being received until Handler returns,
+	// or until it is taken by RecvInto when a queue is enabled. Memory kept
+	// by handlers after returning is not accounted. Zero means no limit.
+	//
+	// Once the limit is reached, scrapers stop reading further records until
+	// memory is released, unless DropOverBudget is set, in which case the
+	// records are dropped and counted by DroppedRecords instead. The limit is
+	// enforced per record, so a single record larger than the limit is still
+	// admitted when nothing else is in flight.
+	MaxInFlightBytes int64
+	DropOverBudget   bool
+	// CloseConcurrency is the number of scrapers CloseAll stops at the same
+	// time. Defaults to 1, stopping them one after another.
+	CloseConcurrency int
+	// CloseTimeout bounds how long CloseAll waits for scrapers to stop. Zero
+	// means no limit.
+	CloseTimeout time.Duration
+	// IdleTimeout hibernates scrapers that have not received a record for
+	// that long, e.g. of targets being down for good, closing them to save
+	// their connection attempts. Hibernated targets do not take scraper
+	// slots, and are resumed after WakeInterval, or by Wake. Zero disables
+	// hibernation, and a zero WakeInterval resumes only by Wake. Scrapers are
+	// checked every quarter of IdleTimeout, at least every nanosecond, on the
+	// Clock set by Options.
+	IdleTimeout  time.Duration
+	WakeInterval time.Duration
+	// Options are applied to every scraper created by the pool.
+	Options []Option
+}
+
+// ScraperPool owns scrapers of many targets, keyed by target address.
+//
+// When there are more targets than MaxScrapers, the targets to scrape are
+// selected by weighted random sampling without replacement: every target
+// draws a key u^(1/w) once when added, where u is uniform in (0, 1) and w is
+// the weight of the component, and the targets with the largest keys are
+// scraped. This gives a target a chance proportional to its weight to be
+// picked before the others, and keeps the selection stable as targets come
+// and go.
+type ScraperPool struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	tlsConfig *tls.Config
+	cfg       PoolConfig
+
+	dialLimiter chan struct{}
+	budget      *memoryBudget
+	// clock is the Clock of the scrapers, set by Options.
+	clock utils.Clock
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	targets map[string]*poolTarget
+	closing bool
+	errs    error // errors of scrapers stopped on their own
+	wg      sync.WaitGroup
+}
+
+// ScraperManager owns one scraper per target and handles targets being added
+// and removed at runtime. It is a ScraperPool scraping all of its targets.
+type ScraperManager = ScraperPool
+
+// NewScraperManager creates a manager applying opts to every scraper.
+func NewScraperManager(ctx context.Context, tlsConfig *tls.Config, opts ...Option) *ScraperManager {
+	return NewScraperPool(ctx, tlsConfig, PoolConfig{Options: opts})
+}
+
+type poolTarget struct {
+	component utils.Component
+	key       float64
+	paused    bool
+	disabled  bool
+	// hibernatedAt is when the target was hibernated for being idle, zero
+	// if it is not.
+	hibernatedAt time.Time
+	scraper      *Scraper
+}
+
+func NewScraperPool(ctx context.Context, tlsConfig *tls.Config, cfg PoolConfig) *ScraperPool {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var dialLimiter chan struct{}
+	if cfg.MaxConcurrentDials > 0 {
+		dialLimiter = make(chan struct{}, cfg.MaxConcurrentDials)
+	}
+	var budget *memoryBudget
+	if cfg.MaxInFlightBytes > 0 {
+		budget = newMemoryBudget(cfg.MaxInFlightBytes, cfg.DropOverBudget)
+	}
+
+	p := &ScraperPool{
+		ctx:         ctx,
+		cancel:      cancel,
+		tlsConfig:   tlsConfig,
+		cfg:         cfg,
+		dialLimiter: dialLimiter,
+		budget:      budget,
+		rand:        rand.New(rand.NewSource(cfg.Seed)),
+		targets:     make(map[string]*poolTarget),
+		clock:       optionsClock(cfg.Options),
+	}
+	if cfg.IdleTimeout > 0 {
+		go p.hibernateLoop()
+	}
+	return p
+}
+
+// Add adds a target to the pool. Adding an address already in the pool is a
+// no-op.
+func (p *ScraperPool) Add(component utils.Component) {
+	p.update(func() []*Scraper {
+		if _, ok := p.targets[component.Addr]; ok {
+			return nil
+		}
+		weight := float64(component.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		p.targets[component.Addr] = &poolTarget{
+			component: component,
+			key:       math.Pow(1-p.rand.Float64(), 1/weight),
+		}
+		return p.rebalance()
+	})
+}
+
+// update runs f with p.mu held, and then closes the scrapers stopped by f.
+// Close blocks until a scraper exits, which must not stall the other methods
+// of the pool, or deadlock a handler calling into the pool.
+func (p *ScraperPool) update(f func() (stopped []*Scraper)) {
+	p.mu.Lock()
+	stopped := f()
+	p.mu.Unlock()
+	for _, s := range stopped {
+		s.Close()
+	}
+}
+
+// ReloadTLS replaces the TLS config of running scrapers, see
+// Scraper.ReloadTLS, and of the ones started later.
+func (p *ScraperPool) ReloadTLS(tlsConfig *tls.Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tlsConfig = tlsConfig
+	for _, t := range p.targets {
+		if t.scraper != nil {
+			t.scraper.ReloadTLS(tlsConfig)
+		}
+	}
+}
+
+// Remove stops scraping the target of the given address and removes it from
+// the pool.
+func (p *ScraperPool) Remove(addr string) {
+	p.update(func() []*Scraper {
+		t, ok := p.targets[addr]
+		if !ok {
+			return nil
+		}
+		delete(p.targets, addr)
+		stopped := p.rebalance()
+		if t.scraper != nil {
+			stopped = append(stopped, t.scraper)
+		}
+		return stopped
+	})
+}
+
+// CloseGroup stops scraping all targets of the group and removes them from
+// the pool.
+func (p *ScraperPool) CloseGroup(group string) {
+	p.update(func() []*Scraper {
+		var stopped []*Scraper
+		for addr, t := range p.targets {
+			if t.component.Group != group {
+				continue
+			}
+			delete(p.targets, addr)
+			if t.scraper != nil {
+				stopped = append(stopped, t.scraper)
+			}
+		}
+		return append(stopped, p.rebalance()...)
+	})
+}
+
+// PauseGroup stops scraping all targets of the group, keeping them in the
+// pool. Paused targets do not take scraper slots.
+func (p *ScraperPool) PauseGroup(group string) {
+	p.setGroupPaused(group, true)
+}
+
+// ResumeGroup resumes scraping targets of the group paused by PauseGroup.
+func (p *ScraperPool) ResumeGroup(group string) {
+	p.setGroupPaused(group, false)
+}
+
+func (p *ScraperPool) setGroupPaused(group string, paused bool) {
+	p.update(func() []*Scraper {
+		for _, t := range p.targets {
+			if t.component.Group == group {
+				t.paused = paused
+			}
+		}
+		return p.rebalance()
+	})
+}
+
+// SetEnabled enables or disables scraping the target of the given address. A
+// disabled target stays in the pool without being scraped or taking a scraper
+// slot, until it is enabled again.
+func (p *ScraperPool) SetEnabled(addr string, enabled bool) {
+	p.update(func() []*Scraper {
+		t, ok := p.targets[addr]
+		if !ok {
+			return nil
+		}
+		t.disabled = !enabled
+		return p.rebalance()
+	})
+}
+
+// Wake resumes scraping the target of the given address if it is hibernated.
+func (p *ScraperPool) Wake(addr string) {
+	p.update(func() []*Scraper {
+		if t, ok := p.targets[addr]; ok && !t.hibernatedAt.IsZero() {
+			t.hibernatedAt = time.Time{}
+			return p.rebalance()
+		}
+		return nil
+	})
+}
+
+// Hibernated returns the components of the targets hibernated for being idle.
+func (p *ScraperPool) Hibernated() []utils.Component {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var components []utils.Component
+	for _, t := range p.sortedTargets() {
+		if !t.hibernatedAt.IsZero() {
+			components = append(components, t.component)
+		}
+	}
+	return components
+}
+
+// optionsClock returns the Clock set by opts, which the scrapers of the pool
+// measure their idleness on.
+func optionsClock(opts []Option) utils.Clock {
+	var cfg ScraperConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.Clock == nil {
+		return utils.RealClock
+	}
+	return cfg.Clock
+}
+
+func (p *ScraperPool) hibernateLoop() {
+	interval := p.cfg.IdleTimeout / 4
+	if interval <= 0 {
+		interval = 1
+	}
+	for {
+		select {
+		case <-p.clock.After(interval):
+			p.hibernateIdle(p.clock.Now())
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// hibernateIdle hibernates scrapers idle for IdleTimeout, and resumes the
+// ones hibernated for WakeInterval.
+func (p *ScraperPool) hibernateIdle(now time.Time) {
+	p.update(func() []*Scraper {
+		changed := false
+		for _, t := range p.targets {
+			switch {
+			case t.hibernatedAt.IsZero() && t.scraper != nil:
+				idleSince := t.scraper.bo.createdAt
+				if last := t.scraper.lastRecordAt.Load(); last != 0 {
+					idleSince = time.Unix(0, last)
+				}
+				if now.Sub(idleSince) >= p.cfg.IdleTimeout {
+					t.hibernatedAt = now
+					changed = true
+				}
+			case !t.hibernatedAt.IsZero() && p.cfg.WakeInterval > 0 && now.Sub(t.hibernatedAt) >= p.cfg.WakeInterval:
+				t.hibernatedAt = time.Time{}
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		return p.rebalance()
+	})
+}
+
+// List returns the components of all targets in the pool, including the ones
+// not being scraped.
+func (p *ScraperPool) List() []utils.Component {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	components := make([]utils.Component, 0, len(p.targets))
+	for _, t := range p.sortedTargets() {
+		components = append(components, t.component)
+	}
+	return components
+}
+
+// Scrapers returns the running scrapers keyed by target address.
+func (p *ScraperPool) Scrapers() map[string]*Scraper {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	scrapers := make(map[string]*Scraper)
+	for addr, t := range p.targets {
+		if t.scraper != nil {
+			scrapers[addr] = t.scraper
+		}
+	}
+	return scrapers
+}
+
+// DroppedRecords returns the number of records dropped for exceeding
+// MaxInFlightBytes when DropOverBudget is set.
+func (p *ScraperPool) DroppedRecords() uint64 {
+	if p.budget == nil {
+		return 0
+	}
+	return p.budget.dropped.Load()
+}
+
+// PoolStats sums the stats of the running scrapers of a pool.
+type PoolStats struct {
+	PoolKindStats
+	// ByKind breaks the sums down by the kind of component.
+	ByKind map[utils.ComponentKind]PoolKindStats
+}
+
+type PoolKindStats struct {
+	// Scrapers is the number of running scrapers, of which Healthy, Degraded
+	// and Down are in the respective HealthState.
+	Scrapers int
+	Healthy  int
+	Degraded int
+	Down     int
+	Records  uint64
+	Bytes    uint64
+	Filtered uint64
+	// FailedAttempts is the number of attempts to dial and subscribe that
+	// failed.
+	FailedAttempts       uint64
+	KeepaliveDisconnects uint64
+}
+
+func (s *PoolKindStats) add(stats Stats, health HealthState) {
+	s.Scrapers++
+	switch health {
+	case Healthy:
+		s.Healthy++
+	case Degraded:
+		s.Degraded++
+	case Down:
+		s.Down++
+	}
+	s.Records += stats.Records
+	s.Bytes += stats.Bytes
+	s.Filtered += stats.Filtered
+	s.FailedAttempts += stats.SubscribeAttempts - stats.SubscribeSuccesses
+	s.KeepaliveDisconnects += stats.KeepaliveDisconnects
+}
+
+// AggregateStats sums the stats of all running scrapers. Targets not being
+// scraped, e.g. paused or hibernated ones, are not included.
+func (p *ScraperPool) AggregateStats() PoolStats {
+	stats := PoolStats{ByKind: make(map[utils.ComponentKind]PoolKindStats)}
+	for _, s := range p.Scrapers() {
+		scraperStats, health := s.Stats(), s.Health()
+		stats.add(scraperStats, health)
+		kindStats := stats.ByKind[s.component.Kind]
+		kindStats.add(scraperStats, health)
+		stats.ByKind[s.component.Kind] = kindStats
+	}
+	return stats
+}
+
+// CloseAll stops all scrapers in the order of their addresses, up to
+// CloseConcurrency at a time, and waits for all of them to exit, or until
+// CloseTimeout. It returns the errors of scrapers that stopped on their own,
+// e.g. after retries were exhausted, combined with an error if the timeout
+// was reached.
+func (p *ScraperPool) CloseAll() error {
+	p.mu.Lock()
+	p.closing = true
+	var scrapers []*Scraper
+	for _, t := range p.targets {
+		if t.scraper != nil {
+			scrapers = append(scrapers, t.scraper)
+			t.scraper = nil
+		}
+	}
+	p.mu.Unlock()
+	sort.Slice(scrapers, func(i, j int) bool {
+		return scrapers[i].component.Addr < scrapers[j].component.Addr
+	})
+
+	var deadline <-chan time.Time
+	if p.cfg.CloseTimeout > 0 {
+		timer := time.NewTimer(p.cfg.CloseTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	concurrency := p.cfg.CloseConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var timedOut bool
+	for _, s := range scrapers {
+		select {
+		case sem <- struct{}{}:
+		case <-deadline:
+			timedOut = true
+		}
+		if timedOut {
+			break
+		}
+		go func(s *Scraper) {
+			s.Close()
+			<-s.Done()
+			<-sem
+		}(s)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(stopped)
+	}()
+	if !timedOut {
+		select {
+		case <-stopped:
+		case <-deadline:
+			timedOut = true
+		}
+	}
+	// Whatever is left is stopped at once.
+	p.cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	errs := p.errs
+	if timedOut {
+		running := 0
+		for _, s := range scrapers {
+			if !s.isDone() {
+				running++
+			}
+		}
+		errs = multierr.Append(errs, fmt.Errorf("%d scrapers did not stop within %s", running, p.cfg.CloseTimeout))
+	}
+	return errs
+}
+
+// sortedTargets returns targets ordered by descending selection key.
+func (p *ScraperPool) sortedTargets() []*poolTarget {
+	targets := make([]*poolTarget, 0, len(p.targets))
+	for _, t := range p.targets {
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].key != targets[j].key {
+			return targets[i].key > targets[j].key
+		}
+		return targets[i].component.Addr < targets[j].component.Addr
+	})
+	return targets
+}
+
+// rebalance starts scrapers for the selected targets and returns the ones of
+// the others, to be closed once p.mu, which it must be called with, is
+// released.
+func (p *ScraperPool) rebalance() (stopped []*Scraper) {
+	if p.closing || p.ctx.Err() != nil {
+		return nil
+	}
+
+	slots := 0
+	for _, t := range p.sortedTargets() {
+		selected := !t.paused && !t.disabled && t.hibernatedAt.IsZero() && (p.cfg.MaxScrapers <= 0 || slots < p.cfg.MaxScrapers)
+		if selected {
+			slots++
+		}
+		switch {
+		case selected && t.scraper == nil:
+			t.scraper = p.start(t.component)
+		case !selected && t.scraper != nil:
+			switch {
+			case t.paused || t.disabled:
+				log.Info("Paused Top SQL scraping", zap.Stringer("target", t.component))
+			case !t.hibernatedAt.IsZero():
+				log.Info("Hibernated idle Top SQL scrape target", zap.Stringer("target", t.component), zap.Duration("idle_timeout", p.cfg.IdleTimeout))
+			default:
+				log.Info("Stopped Top SQL scraping to free a scraper slot", zap.Stringer("target", t.component))
+			}
+			stopped = append(stopped, t.scraper)
+			t.scraper = nil
+		}
+	}
+	return stopped
+}
+
+func (p *ScraperPool) start(component utils.Component) *Scraper {
+	opts := append(p.cfg.Options[:len(p.cfg.Options):len(p.cfg.Options)], func(cfg *ScraperConfig) {
+		cfg.dialLimiter = p.dialLimiter
+		cfg.budget = p.budget
+	})
+	s := NewScraper(p.ctx, component, p.tlsConfig, opts...)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if err := s.Run(); err != nil {
+			p.mu.Lock()
+			p.errs = multierr.Append(p.errs, err)
+			p.mu.Unlock()
+		}
+	}()
+	return s
+}
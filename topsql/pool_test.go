@@ -0,0 +1,129 @@
+package topsql_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+
+	"github.com/breeswish/mockngm/topsql"
+	"github.com/breeswish/mockngm/topsql/topsqltest"
+	"github.com/breeswish/mockngm/utils"
+)
+
+func TestPoolMaxConcurrentDials(t *testing.T) {
+	const (
+		targets  = 6
+		maxDials = 2
+	)
+	var inFlight, maxInFlight, dials atomic.Int32
+	// Every dial takes a while and fails, as if all targets were down at
+	// once.
+	factory := func(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+		n := inFlight.Inc()
+		defer inFlight.Dec()
+		for {
+			max := maxInFlight.Load()
+			if n <= max || maxInFlight.CAS(max, n) {
+				break
+			}
+		}
+		dials.Inc()
+		time.Sleep(20 * time.Millisecond)
+		return nil, errors.New("target down")
+	}
+	p := topsql.NewScraperPool(context.Background(), nil, topsql.PoolConfig{
+		MaxConcurrentDials: maxDials,
+		Options: []topsql.Option{
+			topsql.WithClientConnFactory(factory, false),
+			topsql.WithRetry(time.Millisecond, 3, 3),
+		},
+	})
+	defer p.CloseAll()
+	for i := 0; i < targets; i++ {
+		p.Add(utils.Component{Kind: utils.ComponentTiDB, Addr: fmt.Sprintf("10.0.0.%d:10080", i)})
+	}
+
+	waitFor(t, "dials of all targets", func() bool { return dials.Load() >= 3*targets })
+	if got := maxInFlight.Load(); got != maxDials {
+		t.Errorf("at most %d dials were in flight, want %d", got, maxDials)
+	}
+}
+
+func TestPoolCloseAllStopsScrapers(t *testing.T) {
+	srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+	p := topsql.NewScraperPool(context.Background(), nil, topsql.PoolConfig{
+		CloseConcurrency: 2,
+		Options:          []topsql.Option{topsql.WithContextDialer(srv.Dialer())},
+	})
+	for i := 0; i < 4; i++ {
+		p.Add(utils.Component{Kind: utils.ComponentTiDB, Addr: fmt.Sprintf("10.0.0.%d:10080", i)})
+	}
+	// A scraper failing on its own has its error returned by CloseAll.
+	p.Add(utils.Component{Kind: "unknown", Addr: "10.0.0.9:10080"})
+	scrapers := p.Scrapers()
+	waitFor(t, "all subscriptions", func() bool { return srv.Subscriptions() == 4 })
+
+	err := p.CloseAll()
+	if !errors.Is(err, topsql.ErrUnknownComponentKind) {
+		t.Errorf("CloseAll() = %v, want the error of the failed scraper", err)
+	}
+	if len(scrapers) != 5 {
+		t.Fatalf("pool had %d scrapers, want 5", len(scrapers))
+	}
+	for addr, s := range scrapers {
+		select {
+		case <-s.Done():
+		default:
+			t.Errorf("scraper of %s is still running after CloseAll returned", addr)
+		}
+	}
+	if got := len(p.Scrapers()); got != 0 {
+		t.Errorf("pool has %d scrapers after CloseAll, want 0", got)
+	}
+}
+
+func TestPoolHibernatesOnClock(t *testing.T) {
+	const (
+		idleTimeout  = time.Minute
+		wakeInterval = 10 * time.Minute
+	)
+	clock := topsqltest.NewClock(time.Now())
+	// The target accepts subscriptions but never sends a record.
+	srv := newServer(t, topsqltest.Config{FirstRecordDelay: time.Hour})
+	p := topsql.NewScraperPool(context.Background(), nil, topsql.PoolConfig{
+		IdleTimeout:  idleTimeout,
+		WakeInterval: wakeInterval,
+		Options: []topsql.Option{
+			topsql.WithContextDialer(srv.Dialer()),
+			topsql.WithClock(clock),
+		},
+	})
+	defer p.CloseAll()
+	p.Add(utils.Component{Kind: utils.ComponentTiDB, Addr: "127.0.0.1:10080"})
+
+	waitFor(t, "the subscription", func() bool { return srv.Subscriptions() == 1 })
+	waitFor(t, "the idle check to wait", func() bool { return clock.Timers() > 0 })
+	if got := len(p.Hibernated()); got != 0 {
+		t.Fatalf("%d targets hibernated before IdleTimeout, want 0", got)
+	}
+	clock.Advance(idleTimeout)
+	waitFor(t, "the target to hibernate", func() bool { return len(p.Hibernated()) == 1 && len(p.Scrapers()) == 0 })
+
+	waitFor(t, "the idle check to wait", func() bool { return clock.Timers() > 0 })
+	clock.Advance(wakeInterval)
+	waitFor(t, "the target to wake", func() bool { return len(p.Hibernated()) == 0 && srv.Subscriptions() == 2 })
+}
+
+func TestPoolTinyIdleTimeout(t *testing.T) {
+	// A quarter of the idle timeout rounds down to zero, which must not stop
+	// the idle checks.
+	p := topsql.NewScraperPool(context.Background(), nil, topsql.PoolConfig{IdleTimeout: 3})
+	defer p.CloseAll()
+	p.Add(utils.Component{Kind: utils.ComponentTiDB, Addr: "127.0.0.1:10080"})
+	waitFor(t, "the target to hibernate", func() bool { return len(p.Hibernated()) == 1 })
+}
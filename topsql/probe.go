@@ -0,0 +1,69 @@
+package topsql
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+// ProbeComponentKind detects whether addr serves TiDB or TiKV Top SQL data by
+// subscribing as both kinds. A subscription only counts as working once it
+// delivers a record, so ctx should carry a deadline.
+func ProbeComponentKind(ctx context.Context, addr string, tlsConfig *tls.Config) (utils.ComponentKind, error) {
+	conn, err := dial(ctx, tlsConfig, addr, DefaultConfigFor(""))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tidbErr := probeTiDB(ctx, conn)
+	tikvErr := probeTiKV(ctx, conn)
+
+	switch {
+	case tidbErr == nil && tikvErr == nil:
+		return "", fmt.Errorf("%s serves both TiDB and TiKV Top SQL data", addr)
+	case tidbErr == nil:
+		return utils.ComponentTiDB, nil
+	case tikvErr == nil:
+		return utils.ComponentTiKV, nil
+	default:
+		return "", fmt.Errorf("failed to probe component kind of %s: tidb: %v, tikv: %v", addr, tidbErr, tikvErr)
+	}
+}
+
+func probeTiDB(ctx context.Context, conn *grpc.ClientConn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := tipb.NewTopSQLPubSubClient(conn).Subscribe(ctx, &tipb.TopSQLSubRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	return probeError(err)
+}
+
+func probeTiKV(ctx context.Context, conn *grpc.ClientConn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := resource_usage_agent.NewResourceMeteringPubSubClient(conn).Subscribe(ctx, &resource_usage_agent.ResourceMeteringRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	return probeError(err)
+}
+
+func probeError(err error) error {
+	if status.Code(err) == codes.Unimplemented {
+		return fmt.Errorf("service not implemented")
+	}
+	return err
+}
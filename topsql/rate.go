@@ -0,0 +1,58 @@
+package topsql
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const ewmaTickInterval = time.Second
+
+// ewmaRate is an exponentially weighted moving average of an event rate.
+//
+// Events are accumulated and folded into the average at least
+// ewmaTickInterval apart. For a fold covering an elapsed time dt with n
+// events, the average is updated as:
+//
+//	rate = rate + alpha * (n/dt - rate), alpha = 1 - exp(-dt/window)
+//
+// so the weight of a past interval decays by e after each window, no matter
+// how irregularly folds happen. A short window follows spikes quickly while
+// a long window gives a stable long-term average.
+type ewmaRate struct {
+	mu      sync.Mutex
+	window  time.Duration
+	rate    float64
+	pending uint64
+	last    time.Time
+}
+
+func newEWMARate(window time.Duration, now time.Time) *ewmaRate {
+	return &ewmaRate{window: window, last: now}
+}
+
+func (e *ewmaRate) add(now time.Time, n uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending += n
+	e.fold(now)
+}
+
+// value returns the average rate per second.
+func (e *ewmaRate) value(now time.Time) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.fold(now)
+	return e.rate
+}
+
+func (e *ewmaRate) fold(now time.Time) {
+	dt := now.Sub(e.last)
+	if dt < ewmaTickInterval {
+		return
+	}
+	alpha := 1 - math.Exp(-float64(dt)/float64(e.window))
+	e.rate += alpha * (float64(e.pending)/dt.Seconds() - e.rate)
+	e.pending = 0
+	e.last = now
+}
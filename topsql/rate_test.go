@@ -0,0 +1,65 @@
+package topsql
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEWMARateStep(t *testing.T) {
+	const (
+		fastWindow = 5 * time.Second
+		slowWindow = time.Minute
+	)
+	start := time.Unix(0, 0)
+	fast, slow := newEWMARate(fastWindow, start), newEWMARate(slowWindow, start)
+	now := start
+	// feed records at perSecond for d, in one second ticks.
+	feed := func(perSecond uint64, d time.Duration) {
+		for end := now.Add(d); now.Before(end); {
+			now = now.Add(time.Second)
+			fast.add(now, perSecond)
+			slow.add(now, perSecond)
+		}
+	}
+	near := func(name string, got, want float64) {
+		t.Helper()
+		if math.Abs(got-want) > 0.01*want {
+			t.Errorf("%s = %.2f, want %.2f", name, got, want)
+		}
+	}
+
+	// Both settle on a steady rate.
+	feed(10, 10*time.Minute)
+	near("fast rate before the step", fast.value(now), 10)
+	near("slow rate before the step", slow.value(now), 10)
+
+	// After a step to 100/s, each approaches the new rate by 1-exp(-t/window).
+	const step = 10 * time.Second
+	feed(100, step)
+	near("fast rate after the step", fast.value(now), 100-90*math.Exp(-float64(step)/float64(fastWindow)))
+	near("slow rate after the step", slow.value(now), 100-90*math.Exp(-float64(step)/float64(slowWindow)))
+	if fast.value(now) <= slow.value(now) {
+		t.Errorf("fast rate %.2f did not cross slow rate %.2f after the step up", fast.value(now), slow.value(now))
+	}
+
+	// And the fast one crosses below on the way back down.
+	feed(10, step)
+	if fast.value(now) >= slow.value(now) {
+		t.Errorf("fast rate %.2f did not cross slow rate %.2f after the step down", fast.value(now), slow.value(now))
+	}
+}
+
+func TestEWMARateFoldsOncePerTick(t *testing.T) {
+	start := time.Unix(0, 0)
+	e := newEWMARate(time.Second, start)
+	e.add(start.Add(100*time.Millisecond), 5)
+	if got := e.value(start.Add(500 * time.Millisecond)); got != 0 {
+		t.Errorf("rate = %v within the first tick, want 0 until folded", got)
+	}
+	// The 5 events accumulated over the tick are folded in at once.
+	want := (1 - math.Exp(-1)) * 5
+	if got := e.value(start.Add(time.Second)); math.Abs(got-want) > 1e-9 {
+		t.Errorf("rate = %v after a tick, want %v", got, want)
+	}
+}
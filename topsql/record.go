@@ -0,0 +1,258 @@
+package topsql
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+// ScrapedRecord is a single record received from a scrape target. Exactly one
+// of TiDB and TiKV is set, according to the kind of the component.
+type ScrapedRecord struct {
+	Component  utils.Component
+	SessionID  string
+	ReceivedAt time.Time
+	// Heartbeat marks a synthetic record carrying neither TiDB nor TiKV data,
+	// sent while the target is connected but silent. See
+	// ScraperConfig.HeartbeatInterval.
+	Heartbeat bool
+	// Degraded marks a record the scraper does not fully understand, e.g.
+	// sent by a newer server: a TiDB response of an unknown kind, a TiDB or
+	// TiKV record without data points, a SQL or plan meta without a digest,
+	// or a TiKV record with fields unknown to the client. Such records are
+	// still delivered as is, with whatever fields were decoded, and counted
+	// in Stats.Degraded. An empty SQL digest or resource group tag is not
+	// degraded, as it is sent for statements of other or no SQL.
+	Degraded bool
+	// Snapshot marks a record of the initial snapshot of a stream, as opposed
+	// to an incremental one. See ScraperConfig.SnapshotComplete.
+	Snapshot bool
+
+	TiDB *tipb.TopSQLSubResponse
+	TiKV *resource_usage_agent.ResourceUsageRecord
+
+	release *recordRelease
+	// reserved is the memory budget held by the record while it is queued,
+	// to be released by RecvInto.
+	reserved int
+}
+
+// RecordHandler is invoked from the scrape goroutine for every received record.
+type RecordHandler func(ScrapedRecord) error
+
+func (r ScrapedRecord) size() int {
+	switch {
+	case r.TiDB != nil:
+		return r.TiDB.Size()
+	case r.TiKV != nil:
+		return r.TiKV.Size()
+	}
+	return 0
+}
+
+var jsonMarshaler = jsonpb.Marshaler{OrigName: true}
+
+func (r ScrapedRecord) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch {
+	case r.TiDB != nil:
+		err = jsonMarshaler.Marshal(&buf, r.TiDB)
+	case r.TiKV != nil:
+		err = jsonMarshaler.Marshal(&buf, r.TiKV)
+	default:
+		buf.WriteString("null")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The digests are base64 encoded in the record, so they are repeated hex
+	// encoded, as displayed by TiDB.
+	sqlDigest, planDigest := recordDigests(r)
+	return json.Marshal(struct {
+		Component  string          `json:"component"`
+		Kind       string          `json:"kind"`
+		Addr       string          `json:"addr"`
+		SessionID  string          `json:"session_id"`
+		ReceivedAt time.Time       `json:"received_at"`
+		SQLDigest  string          `json:"sql_digest,omitempty"`
+		PlanDigest string          `json:"plan_digest,omitempty"`
+		Heartbeat  bool            `json:"heartbeat,omitempty"`
+		Degraded   bool            `json:"degraded,omitempty"`
+		Snapshot   bool            `json:"snapshot,omitempty"`
+		Record     json.RawMessage `json:"record"`
+	}{
+		Component:  r.Component.FormatAs(utils.FormatURL),
+		Kind:       string(r.Component.Kind),
+		Addr:       r.Component.Addr,
+		SessionID:  r.SessionID,
+		ReceivedAt: r.ReceivedAt,
+		SQLDigest:  hex.EncodeToString(sqlDigest),
+		PlanDigest: hex.EncodeToString(planDigest),
+		Heartbeat:  r.Heartbeat,
+		Degraded:   r.Degraded,
+		Snapshot:   r.Snapshot,
+		Record:     buf.Bytes(),
+	})
+}
+
+// recordDigests returns the SQL and plan digests of a record with data points
+// or of a SQL or plan meta, whichever the record carries.
+func recordDigests(record ScrapedRecord) (sqlDigest, planDigest []byte) {
+	switch {
+	case record.TiDB.GetRecord() != nil:
+		return record.TiDB.GetRecord().SqlDigest, record.TiDB.GetRecord().PlanDigest
+	case record.TiDB.GetSqlMeta() != nil:
+		return record.TiDB.GetSqlMeta().SqlDigest, nil
+	case record.TiDB.GetPlanMeta() != nil:
+		return nil, record.TiDB.GetPlanMeta().PlanDigest
+	case record.TiKV.GetRecord() != nil:
+		var tag tipb.ResourceGroupTag
+		_ = tag.Unmarshal(record.TiKV.GetRecord().ResourceGroupTag)
+		return tag.SqlDigest, tag.PlanDigest
+	}
+	return nil, nil
+}
+
+func isDegraded(record ScrapedRecord) bool {
+	if r := record.TiDB; r != nil {
+		switch resp := r.RespOneof.(type) {
+		case *tipb.TopSQLSubResponse_Record:
+			return resp.Record == nil || len(resp.Record.Items) == 0
+		case *tipb.TopSQLSubResponse_SqlMeta:
+			return resp.SqlMeta == nil || len(resp.SqlMeta.SqlDigest) == 0
+		case *tipb.TopSQLSubResponse_PlanMeta:
+			return resp.PlanMeta == nil || len(resp.PlanMeta.PlanDigest) == 0
+		}
+		return true
+	}
+	if r := record.TiKV; r != nil {
+		return len(r.XXX_unrecognized) > 0 || len(r.GetRecord().GetItems()) == 0
+	}
+	return false
+}
+
+// RecordTimestamp returns the latest timestamp of the data points carried by
+// the record. It returns false for records without data points, e.g. SQL and
+// plan metas.
+func RecordTimestamp(record ScrapedRecord) (time.Time, bool) {
+	switch {
+	case record.TiDB != nil:
+		return rawRecordTimestamp(record.TiDB)
+	case record.TiKV != nil:
+		return rawRecordTimestamp(record.TiKV)
+	}
+	return time.Time{}, false
+}
+
+func rawRecordTimestamp(record interface{}) (time.Time, bool) {
+	var latest uint64
+	switch r := record.(type) {
+	case *tipb.TopSQLSubResponse:
+		for _, item := range r.GetRecord().GetItems() {
+			if item.TimestampSec > latest {
+				latest = item.TimestampSec
+			}
+		}
+	case *resource_usage_agent.ResourceUsageRecord:
+		for _, item := range r.GetRecord().GetItems() {
+			if item.TimestampSec > latest {
+				latest = item.TimestampSec
+			}
+		}
+	}
+	if latest == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(latest), 0), true
+}
+
+func newSessionID() string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// RecvInto fills buf with queued records, requiring ScraperConfig.QueueSize
+// to be set. It blocks until at least one record is available, then takes
+// whatever else is immediately available up to len(buf) without waiting for
+// more. Once the scraper has stopped and the queue is drained it returns
+// io.EOF.
+func (s *Scraper) RecvInto(buf []ScrapedRecord) (n int, err error) {
+	if s.queue == nil {
+		return 0, errors.New("record queue is not enabled")
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	record, ok := <-s.queue
+	if !ok {
+		return 0, io.EOF
+	}
+	s.dequeued(record)
+	buf[0] = record
+	for n = 1; n < len(buf); n++ {
+		select {
+		case record, ok := <-s.queue:
+			if !ok {
+				return n, nil
+			}
+			s.dequeued(record)
+			buf[n] = record
+		default:
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// Records returns the queue of records, requiring ScraperConfig.QueueSize to
+// be set. The channel is closed once the scraper has stopped, so it can be
+// ranged over. It is nil when the queue is not enabled. Records must not be
+// consumed by both Records and RecvInto.
+func (s *Scraper) Records() <-chan ScrapedRecord {
+	if s.queue != nil {
+		s.queueDirect.Store(true)
+	}
+	return s.queue
+}
+
+// enqueue queues the record, reporting whether it was queued and whether the
+// scraper should go on, stopping once it is closed while waiting for room in
+// the queue. A record dropped as the queue is full is released.
+func (s *Scraper) enqueue(record ScrapedRecord) (queued, ok bool) {
+	if s.cfg.QueueDrop {
+		select {
+		case s.queue <- record:
+			return true, true
+		default:
+			s.queueDropped.Inc()
+			record.Release()
+			return false, true
+		}
+	}
+	select {
+	case s.queue <- record:
+		return true, true
+	case <-s.ctx.Done():
+		return false, false
+	}
+}
+
+func (s *Scraper) dequeued(record ScrapedRecord) {
+	if s.cfg.budget != nil && record.reserved > 0 {
+		s.cfg.budget.release(record.reserved)
+	}
+}
@@ -0,0 +1,74 @@
+package topsql
+
+import (
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+)
+
+var (
+	tidbRecordPool = &sync.Pool{New: func() interface{} { return &tipb.TopSQLSubResponse{} }}
+	tikvRecordPool = &sync.Pool{New: func() interface{} { return &resource_usage_agent.ResourceUsageRecord{} }}
+)
+
+// recvPooled receives the next message of stream into a message taken from
+// pool.
+func recvPooled(stream grpc.ClientStream, pool *sync.Pool) (interface{}, error) {
+	m := pool.Get()
+	if err := stream.RecvMsg(m); err != nil {
+		pool.Put(m)
+		return nil, err
+	}
+	return m, nil
+}
+
+// recordRelease is shared by all copies of a pooled ScrapedRecord, so that its
+// message is returned to the pool at most once.
+type recordRelease struct {
+	released atomic.Bool
+	put      func()
+}
+
+func newRecordRelease(record ScrapedRecord) *recordRelease {
+	switch {
+	case record.TiDB != nil:
+		return &recordRelease{put: func() { tidbRecordPool.Put(record.TiDB) }}
+	case record.TiKV != nil:
+		return &recordRelease{put: func() { tikvRecordPool.Put(record.TiKV) }}
+	}
+	return nil
+}
+
+// Release returns the message of the record for reuse when
+// ScraperConfig.PoolRecords is enabled, and is a no-op otherwise.
+//
+// The record and its message must not be accessed by anyone after calling
+// Release, so it may only be called once all references are dropped, e.g.
+// by the last of several consumers. Calling it more than once is harmless.
+func (r ScrapedRecord) Release() {
+	if r.release != nil && !r.release.released.Swap(true) {
+		r.release.put()
+	}
+}
+
+// retain returns a copy of the record which may be kept after the record is
+// released, copying the message of a pooled record. Other records are
+// returned as is, as their messages are never reused.
+func (r ScrapedRecord) retain() ScrapedRecord {
+	if r.release == nil {
+		return r
+	}
+	if r.TiDB != nil {
+		r.TiDB = proto.Clone(r.TiDB).(*tipb.TopSQLSubResponse)
+	}
+	if r.TiKV != nil {
+		r.TiKV = proto.Clone(r.TiKV).(*resource_usage_agent.ResourceUsageRecord)
+	}
+	r.release = nil
+	r.reserved = 0
+	return r
+}
@@ -0,0 +1,129 @@
+package topsql
+
+import (
+	"sync"
+
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// Relay re-publishes scraped records to its own subscribers, serving both
+// tipb.TopSQLPubSub and resource_usage_agent.ResourceMeteringPubSub, so that
+// records of many targets can be consumed from a single endpoint. TiDB
+// records are sent to TiDB subscribers and TiKV records to TiKV subscribers.
+//
+// Every subscriber has a buffer of its own. Records for a subscriber whose
+// buffer is full are dropped and counted by Dropped, so that a slow
+// subscriber neither blocks the scrapers nor the other subscribers. Records
+// are kept after Handle returns, so scrapers feeding a relay must not enable
+// PoolRecords.
+type Relay struct {
+	bufferSize int
+
+	mu          sync.Mutex
+	subscribers map[*relaySubscriber]struct{}
+	dropped     atomic.Uint64
+}
+
+type relaySubscriber struct {
+	tidb    bool
+	records chan ScrapedRecord
+}
+
+func NewRelay(bufferSize int) *Relay {
+	return &Relay{
+		bufferSize:  bufferSize,
+		subscribers: make(map[*relaySubscriber]struct{}),
+	}
+}
+
+// Register registers the relay as both Top SQL services on the server.
+func (r *Relay) Register(server *grpc.Server) {
+	tipb.RegisterTopSQLPubSubServer(server, relayTiDBService{r})
+	resource_usage_agent.RegisterResourceMeteringPubSubServer(server, relayTiKVService{r})
+}
+
+// Handle is a RecordHandler forwarding the record to the current subscribers.
+func (r *Relay) Handle(record ScrapedRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for sub := range r.subscribers {
+		if (sub.tidb && record.TiDB == nil) || (!sub.tidb && record.TiKV == nil) {
+			continue
+		}
+		select {
+		case sub.records <- record:
+		default:
+			r.dropped.Inc()
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of records dropped for slow subscribers.
+func (r *Relay) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
+// Subscribers returns the number of current subscribers.
+func (r *Relay) Subscribers() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.subscribers)
+}
+
+// serve sends records to a new subscriber until it goes away or fails to
+// receive a record.
+func (r *Relay) serve(tidb bool, stream grpc.ServerStream) error {
+	sub := &relaySubscriber{
+		tidb:    tidb,
+		records: make(chan ScrapedRecord, r.bufferSize),
+	}
+	r.mu.Lock()
+	r.subscribers[sub] = struct{}{}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.subscribers, sub)
+		r.mu.Unlock()
+	}()
+
+	ctx := stream.Context()
+	for {
+		select {
+		case record := <-sub.records:
+			var err error
+			if tidb {
+				err = stream.SendMsg(record.TiDB)
+			} else {
+				err = stream.SendMsg(record.TiKV)
+			}
+			if err != nil {
+				log.Info("Top SQL relay subscriber went away", zap.Error(err))
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+type relayTiDBService struct {
+	r *Relay
+}
+
+func (s relayTiDBService) Subscribe(_ *tipb.TopSQLSubRequest, stream tipb.TopSQLPubSub_SubscribeServer) error {
+	return s.r.serve(true, stream)
+}
+
+type relayTiKVService struct {
+	r *Relay
+}
+
+func (s relayTiKVService) Subscribe(_ *resource_usage_agent.ResourceMeteringRequest, stream resource_usage_agent.ResourceMeteringPubSub_SubscribeServer) error {
+	return s.r.serve(false, stream)
+}
@@ -0,0 +1,59 @@
+package topsql
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// ReservoirSampler keeps a uniform random sample of up to k of all records it
+// handles, using reservoir sampling: the i-th record replaces a random sampled
+// one with probability k/i. Records are kept after Handle returns, so
+// scrapers feeding a sampler must not enable PoolRecords.
+type ReservoirSampler struct {
+	k int
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	seen   uint64
+	sample []ScrapedRecord
+}
+
+// NewReservoirSampler creates a sampler of k records. The seed makes the
+// sample reproducible for the same sequence of records.
+func NewReservoirSampler(k int, seed int64) *ReservoirSampler {
+	return &ReservoirSampler{
+		k:      k,
+		rand:   rand.New(rand.NewSource(seed)),
+		sample: make([]ScrapedRecord, 0, k),
+	}
+}
+
+// Handle is a RecordHandler offering the record to the sample.
+func (r *ReservoirSampler) Handle(record ScrapedRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.seen++
+	if len(r.sample) < r.k {
+		r.sample = append(r.sample, record)
+		return nil
+	}
+	if i := r.rand.Int63n(int64(r.seen)); i < int64(r.k) {
+		r.sample[i] = record
+	}
+	return nil
+}
+
+// Sample returns a copy of the current sample.
+func (r *ReservoirSampler) Sample() []ScrapedRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ScrapedRecord(nil), r.sample...)
+}
+
+// Seen returns the number of records handled so far.
+func (r *ReservoirSampler) Seen() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.seen
+}
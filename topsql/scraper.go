@@ -3,40 +3,147 @@ package topsql
 import (
 	"context"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // registers the gzip compressor
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/breeswish/mockngm/utils"
 )
 
-var (
-	dialTimeout = 5 * time.Second
-)
-
 type Scraper struct {
-	ctx       context.Context
-	cancel    context.CancelFunc
-	tlsConfig *tls.Config
-	component utils.Component
+	ctx         context.Context
+	cancel      context.CancelFunc
+	downMu      sync.Mutex
+	downReason  error // why the scraper was canceled, unless by the context
+	component   utils.Component
+	cfg         ScraperConfig
+	handler     RecordHandler // cfg.Handler wrapped by cfg.Middlewares
+	sink        *recordSinkHandler
+	bo          *backoffScrape
+	done        chan struct{}
+	doneOnce    sync.Once
+	running     atomic.Bool // whether the scrape loop has started
+	connect     chan struct{}
+	queue       chan ScrapedRecord
+	connectOnce sync.Once
+
+	startedAt    time.Time
+	metas        *MetaResolver
+	groupFilter  *resourceGroupFilter
+	digestFilter *digestFilter
+	dedup        *recordDedup
+
+	// Updated by the scrape goroutine and read by Stats from any goroutine.
+	records          atomic.Uint64
+	delivered        atomic.Uint64
+	bytes            atomic.Uint64
+	deltaRecords     atomic.Uint64
+	deltaBytes       atomic.Uint64
+	filtered         atomic.Uint64
+	transformDropped atomic.Uint64
+	teeDropped       atomic.Uint64
+	queueDropped     atomic.Uint64
+	duplicates       atomic.Uint64
+	// queueDirect is set once the queue is consumed via Records, which
+	// bypasses the release of memory budget by RecvInto.
+	queueDirect atomic.Bool
+	degraded    atomic.Uint64
+	fastRate    *ewmaRate
+	slowRate    *ewmaRate
+
+	clockSkew atomic.Duration
+	// lastRecordAt is the receive time in unix nanoseconds of the last record.
+	lastRecordAt atomic.Int64
+	// expired is set once MaxDuration has elapsed.
+	expired atomic.Bool
+
+	// handleMu serializes handler calls of the scrape loop and heartbeats.
+	handleMu sync.Mutex
+
+	lastErrorMu     sync.Mutex
+	lastErrorRecord ScrapedRecord
+	lastError       error
+
+	// Only accessed from the scrape goroutine.
+	skewed      bool
+	lastArrival time.Time
 }
 
-func NewScraper(ctx context.Context, component utils.Component, tlsConfig *tls.Config) *Scraper {
+// NewScraper creates a scraper of the component, configured by opts on top of
+// DefaultConfigFor its kind. It subscribes to everything the target reports:
+// the resource group and SQL digest filters of the config are applied client
+// side, to the records received.
+func NewScraper(ctx context.Context, component utils.Component, tlsConfig *tls.Config, opts ...Option) *Scraper {
 	ctx, cancel := context.WithCancel(ctx)
 
-	return &Scraper{
+	cfg := DefaultConfigFor(component.Kind)
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.SessionID == "" {
+		cfg.SessionID = newSessionID()
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = utils.RealClock
+	}
+	now := cfg.Clock.Now()
+
+	s := &Scraper{
 		ctx:       ctx,
 		cancel:    cancel,
-		tlsConfig: tlsConfig,
 		component: component,
+		cfg:       cfg,
+		bo:        newBackoffScrape(ctx, tlsConfig, component.Addr, component, cfg),
+		done:      make(chan struct{}),
+		connect:   make(chan struct{}),
+
+		groupFilter:  newResourceGroupFilter(cfg.ResourceGroupAllowlist, cfg.ResourceGroupDenylist),
+		digestFilter: newDigestFilter(cfg.SQLDigestAllowlist),
+		dedup:        newRecordDedup(cfg.DedupWindow),
+		fastRate:     newEWMARate(cfg.FastRateWindow, now),
+		slowRate:     newEWMARate(cfg.SlowRateWindow, now),
+
+		startedAt: now,
+	}
+	handler := cfg.Handler
+	if cfg.RecordSink != nil {
+		s.sink = &recordSinkHandler{sink: cfg.RecordSink}
+		handler = s.sink.before(handler)
 	}
+	s.handler = wrapHandler(handler, cfg.Middlewares)
+	if cfg.QueueSize > 0 {
+		s.queue = make(chan ScrapedRecord, cfg.QueueSize)
+	}
+	if cfg.MetaCacheSize > 0 {
+		s.metas = NewMetaResolver(cfg.MetaCacheSize)
+	}
+	if !cfg.Lazy {
+		s.Connect()
+	}
+	return s
 }
 
 func (s *Scraper) IsDown() bool {
@@ -48,221 +155,2031 @@ func (s *Scraper) IsDown() bool {
 	}
 }
 
+// Close stops scraping and, if the scrape loop has started, waits for it to
+// exit, so that the connection is released once Close returns. It must not be
+// called from a RecordHandler, which would wait for itself, use Stop there.
+// Calling it more than once is harmless.
 func (s *Scraper) Close() {
+	s.cancelWith(ErrClosed)
+	if s.running.Load() {
+		<-s.done
+	} else {
+		deleteScraperMetrics(s.component, s.cfg.SessionID)
+	}
+	if s.sink != nil {
+		s.sink.close()
+	}
+}
+
+// Stop stops scraping like Close, without waiting for the scrape loop to
+// exit. Done is closed once it has.
+func (s *Scraper) Stop() {
+	s.cancelWith(ErrClosed)
+	if s.sink != nil {
+		s.sink.close()
+	}
+}
+
+// DownReason returns why the scraper is down, or nil if it is not: ErrClosed
+// if it was closed, the context error if the context passed to NewScraper was
+// done, the error returned by Run if scraping failed, or ErrFinished if it
+// stopped on its own otherwise. Whichever happened first is reported.
+func (s *Scraper) DownReason() error {
+	if !s.IsDown() {
+		return nil
+	}
+	s.downMu.Lock()
+	defer s.downMu.Unlock()
+	if s.downReason != nil {
+		return s.downReason
+	}
+	return s.ctx.Err()
+}
+
+// cancelWith cancels the scraper, recording reason unless it is down already.
+func (s *Scraper) cancelWith(reason error) {
+	s.downMu.Lock()
+	if s.downReason == nil && s.ctx.Err() == nil {
+		s.downReason = reason
+	}
+	s.downMu.Unlock()
 	s.cancel()
 }
 
-func (s *Scraper) Run() {
-	log.Info("Starting Top SQL scraping", zap.Stringer("target", s.component))
-	switch s.component.Kind {
-	case utils.ComponentTiDB:
-		s.scrapeTiDB()
-	case utils.ComponentTiKV:
-		s.scrapeTiKV()
+func (s *Scraper) Component() utils.Component {
+	return s.component
+}
+
+// Session returns the ID and start time of the scrape session. A session
+// spans the whole lifetime of the scraper, including reconnects.
+func (s *Scraper) Session() (id string, startedAt time.Time) {
+	return s.cfg.SessionID, s.startedAt
+}
+
+// Config returns the effective configuration of the scraper, with defaults
+// applied. The TLS config is not part of it, as it may carry private keys.
+func (s *Scraper) Config() ScraperConfig {
+	cfg := s.cfg
+	s.bo.updateMu.Lock()
+	if s.bo.update != nil {
+		copyTunables(&cfg, s.bo.update)
+	} else {
+		copyTunables(&cfg, &s.bo.cfg)
+	}
+	s.bo.updateMu.Unlock()
+	cfg.ResourceGroupAllowlist = append([]string(nil), cfg.ResourceGroupAllowlist...)
+	cfg.ResourceGroupDenylist = append([]string(nil), cfg.ResourceGroupDenylist...)
+	cfg.SQLDigestAllowlist = append([]string(nil), cfg.SQLDigestAllowlist...)
+	cfg.Middlewares = append([]Middleware(nil), cfg.Middlewares...)
+	return cfg
+}
+
+// UpdateConfig changes the retry and timeout settings of a running scraper
+// to the ones of cfg, without reconnecting: FirstWaitTime, MaxRetryTimes,
+// MaxSubscribeRetryTimes, DialTimeout, KeepaliveTime, KeepaliveTimeout,
+// RecvTimeout and MinReconnectInterval. Other fields of cfg are ignored, so
+// it may be a modified copy of Config. The settings are applied by the scrape
+// loop before the next record or reconnect, whichever comes first:
+// RecvTimeout takes effect for the next record, while the others take effect
+// from the next reconnect on, as a reconnect in progress keeps its retry
+// budget and the dial settings apply to new connections only. FirstWaitTime
+// also resets the wait adapted by AdaptiveBackoff. It returns an error,
+// leaving the settings unchanged, if they are invalid, e.g. a DialTimeout
+// which is not positive.
+func (s *Scraper) UpdateConfig(cfg ScraperConfig) error {
+	merged := s.cfg
+	copyTunables(&merged, &cfg)
+	if err := s.validateConfig(&merged); err != nil {
+		return err
+	}
+	s.bo.updateMu.Lock()
+	defer s.bo.updateMu.Unlock()
+	s.bo.update = &cfg
+	s.bo.updated.Store(true)
+	return nil
+}
+
+// ReloadTLS replaces the TLS config of the scraper, e.g. after certificates
+// are rotated. It takes effect from the next dial on, including the ones of a
+// reconnect in progress, while an established connection is kept. A dial in
+// progress uses the config it started with.
+func (s *Scraper) ReloadTLS(tlsConfig *tls.Config) {
+	s.bo.updateMu.Lock()
+	defer s.bo.updateMu.Unlock()
+	s.bo.tlsCfg = tlsConfig
+}
+
+// ConnectedAddr returns the address the scraper is connected to, which is one
+// of ScraperConfig.FailoverAddrs after failing over, or an empty string when
+// it is not connected.
+func (s *Scraper) ConnectedAddr() string {
+	return s.bo.connected.Load()
+}
+
+// LookupSQL returns the normalized SQL of a digest seen in the SQL metas of
+// the target, requiring ScraperConfig.MetaCacheSize to be set.
+func (s *Scraper) LookupSQL(digest []byte) (string, bool) {
+	if s.metas == nil {
+		return "", false
+	}
+	return s.metas.LookupSQL(digest)
+}
+
+// LookupPlan is LookupSQL for plan digests.
+func (s *Scraper) LookupPlan(digest []byte) (string, bool) {
+	if s.metas == nil {
+		return "", false
+	}
+	return s.metas.LookupPlan(digest)
+}
+
+// resolve learns the text of the record if it is a SQL or plan meta, whether
+// or not the record is filtered later.
+func (s *Scraper) resolve(record *tipb.TopSQLSubResponse) {
+	if s.metas != nil {
+		_ = s.metas.Handle(ScrapedRecord{TiDB: record})
+	}
+}
+
+func copyTunables(dst, src *ScraperConfig) {
+	dst.FirstWaitTime = src.FirstWaitTime
+	dst.MaxRetryTimes = src.MaxRetryTimes
+	dst.MaxSubscribeRetryTimes = src.MaxSubscribeRetryTimes
+	dst.DialTimeout = src.DialTimeout
+	dst.KeepaliveTime = src.KeepaliveTime
+	dst.KeepaliveTimeout = src.KeepaliveTimeout
+	dst.RecvTimeout = src.RecvTimeout
+	dst.MinReconnectInterval = src.MinReconnectInterval
+}
+
+// Connect allows a scraper created with ScraperConfig.Lazy to start dialing
+// the target. It is a no-op otherwise.
+func (s *Scraper) Connect() {
+	s.connectOnce.Do(func() { close(s.connect) })
+}
+
+// Done returns a channel which is closed once the scrape loop started by Run
+// has exited and the connection has been released, either because the
+// scraper was closed, its context was cancelled or it gave up reconnecting.
+func (s *Scraper) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Scraper) isDone() bool {
+	select {
+	case <-s.done:
+		return true
 	default:
-		panic("unexpected scrape target")
+		return false
 	}
 }
 
-func (s *Scraper) scrapeTiDB() {
-	bo := newBackoffScrape(s.ctx, s.tlsConfig, s.component.Addr, s.component)
-	defer bo.close()
+// Reconnect cancels the current stream without shutting down the scraper, so
+// that the scrape loop re-establishes it immediately. It is a no-op if the
+// scraper is closed.
+func (s *Scraper) Reconnect() {
+	if s.IsDown() {
+		return
+	}
+	log.Info("Reconnecting Top SQL scrape target", zap.Stringer("target", s.component))
+	s.bo.cancelStream()
+}
 
-	lastLog := time.Now()
-	lastSuppressed := 0
+var (
+	ErrRetryExhausted          = errors.New("retry times exhausted")
+	ErrDialRetryExhausted      = fmt.Errorf("dial %w", ErrRetryExhausted)
+	ErrSubscribeRetryExhausted = fmt.Errorf("subscribe %w", ErrRetryExhausted)
+	// ErrAborted is returned when ScraperConfig.RetryPolicy decided to stop.
+	ErrAborted = errors.New("aborted by retry policy")
+	// ErrClosed and ErrFinished are returned by DownReason for a scraper
+	// stopped by Close or Stop, and one which stopped on its own without an
+	// error, e.g. after MaxRecords or MaxDuration.
+	ErrClosed   = errors.New("scraper closed")
+	ErrFinished = errors.New("scraping finished")
+	// ErrUnknownComponentKind is returned by Run for a target of a kind
+	// that cannot be scraped, e.g. from a malformed topology.
+	ErrUnknownComponentKind = errors.New("unknown component kind")
 
-	for {
-		record := bo.scrapeTiDBRecord()
-		if record == nil {
-			return
-		}
+	errRecvTimeout  = errors.New("record not received in time")
+	errStreamClosed = errors.New("stream closed by the target")
+	// errNilStream and errNilConn guard against a misbehaving client
+	// returning neither a stream nor an error from Subscribe, or
+	// ClientConnFactory neither a connection nor an error.
+	errNilStream = errors.New("subscribe returned no stream")
+	errNilConn   = errors.New("client conn factory returned no connection")
+)
+
+// Run scrapes until the scraper stops, and returns the reason why. It returns nil when
+// the scraper was closed, its context was cancelled or it reached MaxRecords
+// or MaxDuration, and an error wrapping ErrRetryExhausted when the scraper
+// gave up reconnecting, or ErrAborted when the retry policy decided to stop.
+// An invalid configuration, e.g. a target of an unknown kind failing with
+// ErrUnknownComponentKind, is returned at once, without dialing. It fits
+// errgroup supervision, so that a scraper giving up cancels its siblings:
+//
+//	g, ctx := errgroup.WithContext(ctx)
+//	for _, c := range components {
+//		g.Go(topsql.NewScraper(ctx, c, nil).Run)
+//	}
+//	err := g.Wait()
+func (s *Scraper) Run() error {
+	return s.run(s.handler)
+}
 
-		lastSuppressed++
-		if time.Since(lastLog) > time.Second {
-			log.Info("Received Top SQL record", zap.Int("records", lastSuppressed), zap.Stringer("target", s.component))
-			lastLog = time.Now()
-			lastSuppressed = 0
+// RunE is the same as Run.
+//
+// Deprecated: use Run, which returns the error too.
+func (s *Scraper) RunE() error {
+	return s.Run()
+}
+
+// Start starts scraping in the background like `go Run()`, and blocks until
+// the first k records have been received, returning them. These records are
+// passed to the handler as usual. An error is returned along with the records
+// received so far if the scraper stops before k records arrive.
+func (s *Scraper) Start(k int) ([]ScrapedRecord, error) {
+	collected := make(chan ScrapedRecord, k)
+	exited := make(chan error, 1)
+	go func() {
+		n := 0
+		exited <- s.run(func(record ScrapedRecord) error {
+			if n < k && !record.Heartbeat {
+				n++
+				collected <- record
+			}
+			s.handle(s.handler, record)
+			return nil
+		})
+	}()
+
+	records := make([]ScrapedRecord, 0, k)
+	for len(records) < k {
+		select {
+		case record := <-collected:
+			records = append(records, record)
+		case err := <-exited:
+			for len(collected) > 0 {
+				records = append(records, <-collected)
+			}
+			if len(records) == k {
+				return records, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("scraper stopped after %d of %d records", len(records), k)
+			}
+			return records, err
 		}
 	}
+	return records, nil
 }
 
-func (s *Scraper) scrapeTiKV() {
-	bo := newBackoffScrape(s.ctx, s.tlsConfig, s.component.Addr, s.component)
-	defer bo.close()
+// StreamJSON scrapes like Run, additionally writing every record as a line of
+// JSON to w. The scraper is closed when ctx is done or writing fails.
+func (s *Scraper) StreamJSON(ctx context.Context, w io.Writer) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-s.ctx.Done():
+		}
+	}()
 
-	lastLog := time.Now()
-	lastSuppressed := 0
+	var writeErr error
+	runErr := s.run(func(record ScrapedRecord) error {
+		s.handle(s.handler, record)
 
-	for {
-		record := bo.scrapeTiKVRecord()
-		if record == nil {
-			return
+		line, err := record.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if _, err = w.Write(line); err == nil {
+			if f, ok := w.(interface{ Flush() error }); ok {
+				err = f.Flush()
+			}
 		}
-		
-		lastSuppressed++
-		if time.Since(lastLog) > time.Second {
-			log.Info("Received Top SQL record", zap.Int("records", lastSuppressed), zap.Stringer("target", s.component))
-			lastLog = time.Now()
-			lastSuppressed = 0
+		if err != nil {
+			writeErr = err
+			s.Stop()
 		}
+		return err
+	})
+
+	if writeErr != nil {
+		return writeErr
 	}
+	if runErr != nil {
+		return runErr
+	}
+	return ctx.Err()
 }
 
-func dial(ctx context.Context, tlsConfig *tls.Config, addr string) (*grpc.ClientConn, error) {
-	var tlsOption grpc.DialOption
-	if tlsConfig == nil {
-		tlsOption = grpc.WithInsecure()
-	} else {
-		tlsOption = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+func (s *Scraper) run(handler RecordHandler) (err error) {
+	s.running.Store(true)
+	defer s.doneOnce.Do(func() { close(s.done) })
+	defer deleteScraperMetrics(s.component, s.cfg.SessionID)
+	if s.queue != nil {
+		defer close(s.queue)
 	}
+	// Streams are bound to the scraper context, so cancelling it when the
+	// loop exits for whatever reason makes sure nothing is left blocked.
+	defer func() {
+		if err != nil {
+			s.cancelWith(err)
+		} else {
+			s.cancelWith(ErrFinished)
+		}
+	}()
 
-	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
-	defer cancel()
+	select {
+	case <-s.connect:
+	case <-s.ctx.Done():
+		scraperExitsCounter.WithLabelValues(exitCancelled).Inc()
+		return nil
+	}
 
-	return grpc.DialContext(
-		dialCtx,
-		addr,
-		tlsOption,
-		grpc.WithBlock(),
-		grpc.WithKeepaliveParams(keepalive.ClientParameters{
-			Time:    10 * time.Second,
-			Timeout: 3 * time.Second,
-		}),
-		grpc.WithConnectParams(grpc.ConnectParams{
-			Backoff: backoff.Config{
-				BaseDelay:  100 * time.Millisecond, // Default was 1s.
-				Multiplier: 1.6,                    // Default
-				Jitter:     0.2,                    // Default
-				MaxDelay:   3 * time.Second,        // Default was 120s.
-			},
-		}),
-	)
-}
+	if err := s.validate(); err != nil {
+		scraperExitsCounter.WithLabelValues(exitInvalidConfig).Inc()
+		log.Warn("Invalid Top SQL scrape configuration", zap.Stringer("target", s.component), zap.Error(err))
+		return fmt.Errorf("scrape %s: %w", s.component, err)
+	}
 
-type backoffScrape struct {
-	ctx       context.Context
-	tlsCfg    *tls.Config
-	address   string
-	component utils.Component
+	if s.cfg.MaxDuration > 0 {
+		stop := s.cfg.Clock.AfterFunc(s.cfg.MaxDuration, func() {
+			s.expired.Store(true)
+			s.cancelWith(ErrFinished)
+		})
+		defer stop()
+	}
 
-	conn   *grpc.ClientConn
-	client interface{}
-	stream interface{}
+	if s.cfg.HeartbeatInterval > 0 {
+		stop, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			s.heartbeat(handler, stop)
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+
+	log.Info("Starting Top SQL scraping", zap.Stringer("target", s.component))
+	switch s.component.Kind {
+	case utils.ComponentTiDB:
+		s.scrapeTiDB(handler)
+	case utils.ComponentTiKV, utils.ComponentTiFlash:
+		s.scrapeTiKV(handler)
+	case utils.ComponentTiDBTiKV:
+		s.scrapeTiDBTiKV(handler)
+	default:
+		// Rejected by validate already.
+		return fmt.Errorf("scrape %s: %w %q", s.component, ErrUnknownComponentKind, s.component.Kind)
+	}
 
-	firstWaitTime time.Duration
-	maxRetryTimes uint
+	switch {
+	case s.cfg.MaxRecords > 0 && s.delivered.Load() >= s.cfg.MaxRecords:
+		scraperExitsCounter.WithLabelValues(exitMaxRecords).Inc()
+		log.Info("Stopped Top SQL scraping after max records reached",
+			zap.Stringer("target", s.component),
+			zap.Uint64("delivered", s.delivered.Load()),
+			zap.Uint64("received", s.records.Load()),
+			zap.Uint64("filtered", s.filtered.Load()))
+		return nil
+	case s.expired.Load():
+		scraperExitsCounter.WithLabelValues(exitMaxDuration).Inc()
+		log.Info("Stopped Top SQL scraping after max duration elapsed",
+			zap.Stringer("target", s.component),
+			zap.Duration("duration", s.cfg.MaxDuration),
+			zap.Uint64("delivered", s.delivered.Load()),
+			zap.Uint64("received", s.records.Load()),
+			zap.Uint64("filtered", s.filtered.Load()))
+		return nil
+	case s.bo.ended:
+		scraperExitsCounter.WithLabelValues(exitEOF).Inc()
+		log.Info("Stopped Top SQL scraping after the stream was ended by the target", zap.Stringer("target", s.component))
+		return nil
+	case s.ctx.Err() != nil:
+		scraperExitsCounter.WithLabelValues(exitCancelled).Inc()
+		return nil
+	}
+	if errors.Is(s.bo.stopErr, ErrAborted) {
+		scraperExitsCounter.WithLabelValues(exitAborted).Inc()
+		log.Warn("Stopped Top SQL scraping as decided by the retry policy", zap.Stringer("target", s.component))
+		return fmt.Errorf("scrape %s: %w", s.component, s.bo.stopErr)
+	}
+	scraperExitsCounter.WithLabelValues(exitRetryExhausted).Inc()
+	log.Warn("Stopped Top SQL scraping after retries exhausted", zap.Stringer("target", s.component))
+	return fmt.Errorf("scrape %s: %w", s.component, s.bo.stopErr)
 }
 
-func newBackoffScrape(ctx context.Context, tlsCfg *tls.Config, address string, component utils.Component) *backoffScrape {
-	return &backoffScrape{
-		ctx:       ctx,
-		tlsCfg:    tlsCfg,
-		address:   address,
-		component: component,
+// checkClockSkew measures the difference between the local receive time and
+// the latest timestamp of the record, warning once when it goes beyond the
+// threshold.
+func (s *Scraper) checkClockSkew(record ScrapedRecord) {
+	ts, ok := RecordTimestamp(record)
+	if !ok {
+		return
+	}
+	skew := record.ReceivedAt.Sub(ts)
+	s.clockSkew.Store(skew)
 
-		firstWaitTime: 2 * time.Second,
-		maxRetryTimes: 8,
+	threshold := s.cfg.ClockSkewThreshold
+	skewed := threshold > 0 && (skew > threshold || skew < -threshold)
+	if skewed && !s.skewed {
+		log.Warn("Top SQL record timestamps are skewed from local clock",
+			zap.Stringer("target", s.component),
+			zap.Duration("skew", skew),
+			zap.Duration("threshold", threshold))
 	}
+	s.skewed = skewed
 }
 
-func (bo *backoffScrape) scrapeTiDBRecord() *tipb.TopSQLSubResponse {
-	if record := bo.scrape(); record != nil {
-		if res, ok := record.(*tipb.TopSQLSubResponse); ok {
-			return res
+// newRecord fills in the metadata of a record just received.
+func (s *Scraper) newRecord(record ScrapedRecord) ScrapedRecord {
+	record.Component = s.component
+	record.SessionID = s.cfg.SessionID
+	record.ReceivedAt = s.cfg.Clock.Now()
+	if record.Degraded = isDegraded(record); record.Degraded {
+		s.degraded.Inc()
+	}
+	record.Snapshot = s.bo.snapshot
+	if s.cfg.PoolRecords {
+		record.release = newRecordRelease(record)
+	}
+	return record
+}
+
+// deliver passes the record to handler and reports whether more records
+// should be scraped.
+func (s *Scraper) deliver(handler RecordHandler, record ScrapedRecord) bool {
+	record, ok := s.transform(record)
+	if !ok {
+		return true
+	}
+	s.checkClockSkew(record)
+	// The size is taken up front, as the handler may release the record.
+	budget, size := s.cfg.budget, record.size()
+	if budget != nil && !budget.acquire(s.ctx, size) {
+		record.Release()
+		return s.ctx.Err() == nil
+	}
+	if !s.tee(record) {
+		if budget != nil {
+			budget.release(size)
+		}
+		return false
+	}
+	s.handleMu.Lock()
+	s.handle(handler, record)
+	s.handleMu.Unlock()
+	if s.queue != nil {
+		// A record queued for RecvInto holds its memory until dequeued, while
+		// Records has its consumer release nothing.
+		hold := budget != nil && !s.queueDirect.Load()
+		if hold {
+			record.reserved = size
+		}
+		queued, ok := s.enqueue(record)
+		if budget != nil && (!queued || !hold) {
+			budget.release(size)
+		}
+		if !ok {
+			return false
 		}
+	} else if budget != nil {
+		budget.release(size)
 	}
-	return nil
+	delivered := s.delivered.Inc()
+	return s.cfg.MaxRecords == 0 || delivered < s.cfg.MaxRecords
 }
 
-func (bo *backoffScrape) scrapeTiKVRecord() *resource_usage_agent.ResourceUsageRecord {
-	if record := bo.scrape(); record != nil {
-		if res, ok := record.(*resource_usage_agent.ResourceUsageRecord); ok {
-			return res
+// tee copies the record to ScraperConfig.Tee, reporting false if the scraper
+// is closed while blocking on it.
+func (s *Scraper) tee(record ScrapedRecord) bool {
+	if s.cfg.Tee == nil {
+		return true
+	}
+	if s.cfg.TeePolicy == TeeDrop {
+		select {
+		case s.cfg.Tee <- record:
+		default:
+			s.teeDropped.Inc()
 		}
+		return true
+	}
+	select {
+	case s.cfg.Tee <- record:
+		return true
+	case <-s.ctx.Done():
+		return false
 	}
-	return nil
 }
 
-func (bo *backoffScrape) scrape() interface{} {
-	if bo.stream != nil {
-		switch s := bo.stream.(type) {
-		case tipb.TopSQLPubSub_SubscribeClient:
-			if record, _ := s.Recv(); record != nil {
-				return record
-			}
-		case resource_usage_agent.ResourceMeteringPubSub_SubscribeClient:
-			if record, _ := s.Recv(); record != nil {
-				return record
+// transform applies ScraperConfig.Transform, reporting false if the record
+// is dropped.
+func (s *Scraper) transform(record ScrapedRecord) (ScrapedRecord, bool) {
+	if s.cfg.Transform == nil {
+		return record, true
+	}
+	var raw interface{}
+	if record.TiDB != nil {
+		raw = record.TiDB
+	} else {
+		raw = record.TiKV
+	}
+	transformed := record
+	transformed.TiDB, transformed.TiKV = nil, nil
+	switch r := s.cfg.Transform(raw).(type) {
+	case *tipb.TopSQLSubResponse:
+		transformed.TiDB = r
+	case *resource_usage_agent.ResourceUsageRecord:
+		transformed.TiKV = r
+	}
+	if transformed.TiDB == nil && transformed.TiKV == nil {
+		// Released via the original record, whose messages are the pooled
+		// ones.
+		record.Release()
+		s.transformDropped.Inc()
+		return record, false
+	}
+	return transformed, true
+}
+
+func (s *Scraper) handle(handler RecordHandler, record ScrapedRecord) {
+	if handler == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("Top SQL record handler panicked", zap.Stringer("target", s.component), zap.Any("panic", r), zap.Stack("stack"))
+			s.setLastError(record, fmt.Errorf("record handler panicked: %v", r))
+			if s.cfg.StopOnHandlerPanic {
+				s.Stop()
 			}
 		}
+	}()
+	if err := handler(record); err != nil {
+		log.Warn("Failed to handle Top SQL record", zap.Stringer("target", s.component), zap.Error(err))
+		s.setLastError(record, err)
 	}
+}
 
-	return bo.backoffScrape()
+func (s *Scraper) setLastError(record ScrapedRecord, err error) {
+	s.lastErrorMu.Lock()
+	defer s.lastErrorMu.Unlock()
+	s.lastErrorRecord, s.lastError = record, err
 }
 
-func (bo *backoffScrape) backoffScrape() (record interface{}) {
-	utils.WithRetryBackoff(bo.ctx, bo.maxRetryTimes, bo.firstWaitTime, func(retried uint) bool {
-		if bo.conn != nil {
-			_ = bo.conn.Close()
-			bo.conn = nil
-			bo.client = nil
-			bo.stream = nil
+// LastErrorRecord returns the last record for which the handler returned an
+// error or panicked, along with the error, to reproduce the failure with real
+// data. It returns a nil error if the handler has never failed. The messages
+// of the record are not usable if the handler has released it.
+func (s *Scraper) LastErrorRecord() (ScrapedRecord, error) {
+	s.lastErrorMu.Lock()
+	defer s.lastErrorMu.Unlock()
+	return s.lastErrorRecord, s.lastError
+}
+
+func (s *Scraper) scrapeTiDB(handler RecordHandler) {
+	bo := s.bo
+	defer bo.close()
+
+	recordLogs := logThrottle{interval: time.Second, last: s.cfg.Clock.Now()}
+
+	for {
+		record, err := bo.scrapeTiDBRecord()
+		if err != nil {
+			return
+		}
+		s.countRecord(record.Size())
+		s.resolve(record)
+		if !s.digestFilter.match(ScrapedRecord{TiDB: record}) {
+			s.filtered.Inc()
+			s.newRecord(ScrapedRecord{TiDB: record}).Release()
+			continue
+		}
+		if s.dedup.duplicate(ScrapedRecord{TiDB: record}) {
+			s.duplicates.Inc()
+			s.newRecord(ScrapedRecord{TiDB: record}).Release()
+			continue
+		}
+		if !s.deliver(handler, s.newRecord(ScrapedRecord{TiDB: record})) {
+			return
+		}
+
+		if n, ok := recordLogs.tick(s.cfg.Clock.Now()); ok {
+			s.logRecords(n)
 		}
+	}
+}
+
+func (s *Scraper) logRecords(n int) {
+	if ce := log.L().Check(s.cfg.RecordLogLevel, "Received Top SQL record"); ce != nil {
+		ce.Write(zap.Int("records", n), zap.Stringer("target", s.component))
+	}
+}
+
+func (s *Scraper) scrapeTiKV(handler RecordHandler) {
+	bo := s.bo
+	defer bo.close()
 
-		conn, err := dial(bo.ctx, bo.tlsCfg, bo.address)
+	recordLogs := logThrottle{interval: time.Second, last: s.cfg.Clock.Now()}
+
+	for {
+		record, err := bo.scrapeTiKVRecord()
 		if err != nil {
-			log.Warn("Failed to dial Top SQL scrape target", zap.Stringer("target", bo.component), zap.Error(err))
-			return false
+			return
+		}
+		s.countRecord(record.Size())
+		if !s.groupFilter.match(record) || !s.digestFilter.match(ScrapedRecord{TiKV: record}) {
+			s.filtered.Inc()
+			s.newRecord(ScrapedRecord{TiKV: record}).Release()
+			continue
+		}
+		if s.dedup.duplicate(ScrapedRecord{TiKV: record}) {
+			s.duplicates.Inc()
+			s.newRecord(ScrapedRecord{TiKV: record}).Release()
+			continue
+		}
+		if !s.deliver(handler, s.newRecord(ScrapedRecord{TiKV: record})) {
+			return
 		}
 
-		bo.conn = conn
-		switch bo.component.Kind {
-		case utils.ComponentTiDB:
-			client := tipb.NewTopSQLPubSubClient(conn)
-			bo.client = client
-			stream, err := client.Subscribe(bo.ctx, &tipb.TopSQLSubRequest{})
-			if err != nil {
-				log.Warn("Failed to call Top SQL Subscribe", zap.Stringer("target", bo.component), zap.Error(err))
-				return false
-			}
-			bo.stream = stream
-			record, err = stream.Recv()
-			if err != nil {
-				log.Warn("Failed to call Top SQL Subscribe", zap.Stringer("target", bo.component), zap.Error(err))
-				return false
-			}
+		if n, ok := recordLogs.tick(s.cfg.Clock.Now()); ok {
+			s.logRecords(n)
+		}
+	}
+}
 
-			return true
+func (s *Scraper) scrapeTiDBTiKV(handler RecordHandler) {
+	bo := s.bo
+	defer bo.close()
 
-		case utils.ComponentTiKV:
-			client := resource_usage_agent.NewResourceMeteringPubSubClient(conn)
-			bo.client = client
-			stream, err := client.Subscribe(bo.ctx, &resource_usage_agent.ResourceMeteringRequest{})
-			if err != nil {
-				log.Warn("Failed to call Top SQL Subscribe", zap.Stringer("target", bo.component), zap.Error(err))
-				return false
-			}
-			bo.stream = stream
-			record, err = stream.Recv()
-			if err != nil {
-				log.Warn("Failed to call Top SQL Subscribe", zap.Stringer("target", bo.component), zap.Error(err))
-				return false
-			}
+	recordLogs := logThrottle{interval: time.Second, last: s.cfg.Clock.Now()}
 
-			return true
+	for {
+		var record ScrapedRecord
+		raw, err := bo.scrape()
+		if err != nil {
+			return
+		}
+		switch r := raw.(type) {
+		case *tipb.TopSQLSubResponse:
+			s.countRecord(r.Size())
+			s.resolve(r)
+			record.TiDB = r
+		case *resource_usage_agent.ResourceUsageRecord:
+			s.countRecord(r.Size())
+			if !s.groupFilter.match(r) {
+				s.filtered.Inc()
+				s.newRecord(ScrapedRecord{TiKV: r}).Release()
+				continue
+			}
+			record.TiKV = r
 		default:
-			return true
+			return
+		}
+		if !s.digestFilter.match(record) {
+			s.filtered.Inc()
+			s.newRecord(record).Release()
+			continue
+		}
+		if s.dedup.duplicate(record) {
+			s.duplicates.Inc()
+			s.newRecord(record).Release()
+			continue
+		}
+		if !s.deliver(handler, s.newRecord(record)) {
+			return
 		}
-	})
 
-	return
+		if n, ok := recordLogs.tick(s.cfg.Clock.Now()); ok {
+			s.logRecords(n)
+		}
+	}
 }
 
-func (bo *backoffScrape) close() {
-	if bo.conn != nil {
-		_ = bo.conn.Close()
-		bo.conn = nil
-		bo.client = nil
-		bo.stream = nil
+// validate checks the configuration before dialing, so that obvious mistakes
+// fail at once instead of after dial timeouts.
+func (s *Scraper) validate() error {
+	return s.validateConfig(&s.cfg)
+}
+
+// validateConfig checks cfg as the configuration of the scraper.
+func (s *Scraper) validateConfig(cfg *ScraperConfig) error {
+	switch s.component.Kind {
+	case utils.ComponentTiDB, utils.ComponentTiKV, utils.ComponentTiFlash, utils.ComponentTiDBTiKV:
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownComponentKind, s.component.Kind)
+	}
+	// A custom dialer may accept any address.
+	if cfg.Conn == nil && cfg.ContextDialer == nil && cfg.ClientConnFactory == nil {
+		for _, addr := range s.bo.addrs {
+			if err := validateAddr(addr); err != nil {
+				return err
+			}
+		}
+	}
+	if cfg.DialTimeout <= 0 {
+		return fmt.Errorf("invalid dial timeout %v: must be positive", cfg.DialTimeout)
+	}
+	if cfg.MaxRetryTimes == 0 {
+		return errors.New("invalid max retry times 0: must be positive")
+	}
+	if cfg.FirstWaitTime <= 0 {
+		return fmt.Errorf("invalid first wait time %v: must be positive", cfg.FirstWaitTime)
+	}
+	if cfg.ConnectBackoff.BaseDelay <= 0 || cfg.ConnectBackoff.MaxDelay < cfg.ConnectBackoff.BaseDelay {
+		return fmt.Errorf("invalid connect backoff delays %v to %v: the base delay must be positive and not exceed the max one",
+			cfg.ConnectBackoff.BaseDelay, cfg.ConnectBackoff.MaxDelay)
+	}
+	if cfg.MaxRecvMsgSize <= 0 {
+		return fmt.Errorf("invalid max receive message size %d: must be positive", cfg.MaxRecvMsgSize)
+	}
+	for _, digest := range cfg.SQLDigestAllowlist {
+		if _, err := hex.DecodeString(digest); err != nil {
+			return fmt.Errorf("invalid SQL digest %q: %w", digest, err)
+		}
+	}
+	for _, list := range [][]string{cfg.ResourceGroupAllowlist, cfg.ResourceGroupDenylist} {
+		for _, item := range list {
+			if err := validateResourceGroupItem(item); err != nil {
+				return err
+			}
+		}
+	}
+	if cfg.MaxStreamLifetime < 0 {
+		return fmt.Errorf("invalid max stream lifetime %v: must not be negative", cfg.MaxStreamLifetime)
+	}
+	if cfg.Mode == ModePolling && (cfg.PollWindow <= 0 || cfg.PollInterval < cfg.PollWindow) {
+		return fmt.Errorf("invalid poll window %v and interval %v: the window must be positive and not exceed the interval", cfg.PollWindow, cfg.PollInterval)
+	}
+	if cfg.DedupWindow < 0 {
+		return fmt.Errorf("invalid dedup window %v: must not be negative", cfg.DedupWindow)
+	}
+	if cfg.Compressor != "" && encoding.GetCompressor(cfg.Compressor) == nil {
+		return fmt.Errorf("unknown compressor %q", cfg.Compressor)
+	}
+	if cfg.ServiceConfig != "" {
+		var config map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(cfg.ServiceConfig), &config); err != nil {
+			return fmt.Errorf("invalid service config: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateAddr checks that addr is a host:port.
+func validateAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid address %q: missing host", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid address %q: invalid port", addr)
+	}
+	return nil
+}
+
+var connectBackoff = backoff.Config{
+	BaseDelay:  100 * time.Millisecond, // Default was 1s.
+	Multiplier: 1.6,                    // Default
+	Jitter:     0.2,                    // Default
+	MaxDelay:   3 * time.Second,        // Default was 120s.
+}
+
+func balancing(cfg ScraperConfig) bool {
+	return cfg.LoadBalancingPolicy != "" && cfg.LoadBalancingPolicy != LoadBalancingPickFirst
+}
+
+// dialTarget returns the gRPC target to dial for addr.
+func dialTarget(addr string, cfg ScraperConfig) string {
+	// Balancing only makes sense when all backends are known, so resolve the
+	// address via DNS instead of the default passthrough resolver.
+	if balancing(cfg) && !strings.Contains(addr, "://") {
+		return "dns:///" + addr
+	}
+	return addr
+}
+
+// serviceConfig returns the default service config to dial with, if any.
+func serviceConfig(cfg ScraperConfig) string {
+	if cfg.ServiceConfig != "" {
+		return cfg.ServiceConfig
+	}
+	if balancing(cfg) {
+		return fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, cfg.LoadBalancingPolicy)
+	}
+	return ""
+}
+
+func dial(ctx context.Context, tlsConfig *tls.Config, addr string, cfg ScraperConfig, extraOpts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	var tlsOption grpc.DialOption
+	if tlsConfig == nil {
+		tlsOption = grpc.WithInsecure()
+	} else {
+		tlsOption = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+
+	opts := []grpc.DialOption{
+		tlsOption,
+		grpc.WithBlock(),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    cfg.KeepaliveTime,
+			Timeout: cfg.KeepaliveTimeout,
+		}),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(cfg.MaxRecvMsgSize)),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: cfg.ConnectBackoff,
+		}),
+	}
+	if config := serviceConfig(cfg); config != "" {
+		opts = append(opts, grpc.WithDefaultServiceConfig(config))
+	}
+	if cfg.UserAgent != "" {
+		opts = append(opts, grpc.WithUserAgent(cfg.UserAgent))
+	}
+	addr = dialTarget(addr, cfg)
+
+	opts = append(opts, extraOpts...)
+
+	dialCtx, cancel := context.WithTimeout(ctx, cfg.DialTimeout)
+	defer cancel()
+
+	return grpc.DialContext(dialCtx, addr, opts...)
+}
+
+type backoffScrape struct {
+	ctx    context.Context
+	tlsCfg *tls.Config // guarded by updateMu
+	// addrs are the address of the component followed by FailoverAddrs.
+	addrs     []string
+	addrIndex int // of the address dialed last, only accessed by the scrape goroutine
+	connected atomic.String
+	// state is the connection state last reported to OnStateChange.
+	state atomic.Int32
+	// reconnects is the number of reconnect cycles after a subscription was
+	// lost, and lastErr the last error a connection failed or broke with.
+	reconnects atomic.Uint64
+	// failureLogs throttles logFailure per FailureLogInterval.
+	failureLogs logThrottle
+	lastErr     atomic.Error
+	// uncompressed is set once the target rejected cfg.Compressor.
+	uncompressed atomic.Bool
+	component    utils.Component
+	cfg          ScraperConfig
+
+	// mu guards conn, client and stream, which may be torn down by Reconnect
+	// or the receive timeout from other goroutines.
+	mu     sync.Mutex
+	conn   *grpc.ClientConn
+	client interface{}
+	stream interface{}
+	// streamCancel cancels the context of the current stream, which is
+	// derived from ctx: canceling ctx shuts the scraper down, while canceling
+	// the stream context only ends the current stream, after which the scrape
+	// loop reconnects.
+	streamCancel context.CancelFunc
+	reconnecting bool   // the stream is canceled by Reconnect
+	expired      bool   // the stream is canceled as it reached MaxStreamLifetime or PollWindow
+	streamGen    uint64 // incremented for every stream, so that stale timers do not expire a later one
+	// pollStartedAt is when the current poll subscribed, only accessed by the
+	// scrape goroutine.
+	pollStartedAt time.Time
+
+	firstWaitTime atomic.Duration
+
+	// update is the config passed to UpdateConfig and not applied yet.
+	// Applying it writes cfg under updateMu, so the fields it changes may
+	// be read from other goroutines under updateMu.
+	updateMu sync.Mutex
+	update   *ScraperConfig
+	updated  atomic.Bool
+
+	dialOpts []grpc.DialOption
+	metrics  *scraperMetrics
+
+	// Read by Stats from any goroutine.
+	retried atomic.Uint32
+	// dialRetried and subscribeRetried split retried by the stage whose
+	// failure is retried.
+	dialRetried          atomic.Uint32
+	subscribeRetried     atomic.Uint32
+	keepaliveDisconnects atomic.Uint64
+	encrypted            atomic.Bool
+	// subscribeAttempts counts attempts to dial and subscribe, of which
+	// subscribeSuccesses succeeded.
+	subscribeAttempts  atomic.Uint64
+	subscribeSuccesses atomic.Uint64
+	outOfOrder         atomic.Uint64
+	// Durations of successful dials.
+	lastDialDuration  atomic.Duration
+	totalDialDuration atomic.Duration
+	dials             atomic.Uint64
+	serverVersion     atomic.String
+	// streamLostAt is the time in unix nanoseconds since when there is no
+	// stream, or zero while subscribed.
+	streamLostAt atomic.Int64
+	// streamUpAt is the time in unix nanoseconds of the last subscription.
+	// uptime and downtime accumulate the durations of finished periods with
+	// and without a stream, in nanoseconds.
+	streamUpAt atomic.Int64
+	uptime     atomic.Int64
+	downtime   atomic.Int64
+
+	createdAt time.Time
+
+	// Only accessed from the scrape goroutine.
+	lastReconnect time.Time
+	subscribedAt  time.Time
+	// consecutiveFailures counts failed attempts since the last successful
+	// subscription.
+	consecutiveFailures int
+	ended               bool // the target ended the stream for good
+	dialFailures        uint
+	subscribeFailures   uint
+	// stopErr is why the last reconnect gave up, e.g. the exhausted retry
+	// budget.
+	stopErr      error
+	failingSince time.Time
+	// resumeFrom is the latest timestamp received so far in unix seconds,
+	// accessed atomically to be read by MarshalState.
+	resumeFrom atomic.Int64
+	// The latest timestamps of the current stream, and whether a record out
+	// of order has been logged for it.
+	lastTiDBTimestamp time.Time
+	lastTiKVTimestamp time.Time
+	outOfOrderLogged  bool
+	// inSnapshot reports whether the current stream is in its snapshot, and
+	// snapshot whether the record just scraped belongs to it.
+	inSnapshot bool
+	snapshot   bool
+}
+
+func newBackoffScrape(ctx context.Context, tlsCfg *tls.Config, address string, component utils.Component, cfg ScraperConfig) *backoffScrape {
+	var dialOpts []grpc.DialOption
+	if cfg.Conn != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(preDialed(cfg.Conn)))
+	} else if cfg.ContextDialer != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(cfg.ContextDialer))
+	}
+	if len(cfg.UnaryInterceptors) > 0 {
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(cfg.UnaryInterceptors...))
+	}
+	if len(cfg.StreamInterceptors) > 0 {
+		dialOpts = append(dialOpts, grpc.WithChainStreamInterceptor(cfg.StreamInterceptors...))
+	}
+
+	bo := &backoffScrape{
+		ctx:       ctx,
+		tlsCfg:    tlsCfg,
+		addrs:     append([]string{address}, cfg.FailoverAddrs...),
+		component: component,
+		cfg:       cfg,
+
+		dialOpts:  dialOpts,
+		createdAt: cfg.Clock.Now(),
+		metrics:   newScraperMetrics(component, cfg.SessionID),
+	}
+	bo.failureLogs.interval = cfg.FailureLogInterval
+	bo.firstWaitTime.Store(cfg.FirstWaitTime)
+	bo.streamLostAt.Store(bo.createdAt.UnixNano())
+	return bo
+}
+
+// preDialed returns a dialer handing out the given connection once. Any
+// further dial, e.g. a reconnect, fails because the connection cannot be
+// re-established.
+func preDialed(conn net.Conn) func(context.Context, string) (net.Conn, error) {
+	var used atomic.Bool
+	return func(context.Context, string) (net.Conn, error) {
+		if used.Swap(true) {
+			return nil, errors.New("pre-dialed connection has already been used")
+		}
+		return conn, nil
+	}
+}
+
+func (bo *backoffScrape) scrapeTiDBRecord() (*tipb.TopSQLSubResponse, error) {
+	record, err := bo.scrape()
+	if err != nil {
+		return nil, err
+	}
+	res, ok := record.(*tipb.TopSQLSubResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected record %T", record)
+	}
+	return res, nil
+}
+
+func (bo *backoffScrape) scrapeTiKVRecord() (*resource_usage_agent.ResourceUsageRecord, error) {
+	record, err := bo.scrape()
+	if err != nil {
+		return nil, err
+	}
+	res, ok := record.(*resource_usage_agent.ResourceUsageRecord)
+	if !ok {
+		return nil, fmt.Errorf("unexpected record %T", record)
+	}
+	return res, nil
+}
+
+// scrape returns the next record, reconnecting as needed. It fails with
+// errStreamClosed once the target ended the stream for good, or with why it
+// gave up reconnecting, or the context error once the scraper is closed.
+func (bo *backoffScrape) scrape() (interface{}, error) {
+	bo.applyUpdate()
+
+	bo.mu.Lock()
+	stream, gen := bo.stream, bo.streamGen
+	bo.mu.Unlock()
+
+	if stream != nil {
+		// The window of a poll is enforced by the timer started by subscribe.
+		var stopLifetime func() bool
+		if lifetime := bo.cfg.MaxStreamLifetime; lifetime > 0 && bo.cfg.Mode != ModePolling {
+			age := bo.since(time.Unix(0, bo.streamUpAt.Load()))
+			if age >= lifetime {
+				return bo.recycle()
+			}
+			stopLifetime = bo.cfg.Clock.AfterFunc(lifetime-age, func() { bo.expireStream(gen) })
+		}
+		var stopTimer func() bool
+		if bo.cfg.RecvTimeout > 0 {
+			// Closing the connection unblocks the pending Recv, which then
+			// fails and triggers a reconnect below.
+			stopTimer = bo.cfg.Clock.AfterFunc(bo.cfg.RecvTimeout, func() {
+				log.Info("Top SQL record not received in time, reconnecting", zap.Stringer("target", bo.component), zap.Duration("timeout", bo.cfg.RecvTimeout))
+				bo.closeWith(errRecvTimeout)
+			})
+		}
+		record, err := recv(stream, bo.cfg.PoolRecords)
+		if stopTimer != nil {
+			stopTimer()
+		}
+		if stopLifetime != nil {
+			stopLifetime()
+		}
+		if record != nil {
+			bo.track(record)
+			return record, nil
+		}
+		if bo.takeExpired() {
+			return bo.recycle()
+		}
+		bo.readTrailer(stream)
+		if bo.streamEnded(err) {
+			bo.closeWith(err)
+			bo.ended = true
+			return nil, errStreamClosed
+		}
+		switch bo.decide(err) {
+		case RetryDecisionAbort:
+			bo.abort("Top SQL stream failed", err)
+			bo.closeWith(err)
+			return nil, bo.stopErr
+		case RetryDecisionRetry:
+			bo.lostStream()
+			bo.endStream()
+			return bo.reconnect(true)
+		}
+		bo.closeWith(err)
+	}
+	return bo.reconnect(false)
+}
+
+// expireStream cancels stream gen as it reached MaxStreamLifetime or
+// PollWindow, for the pending Recv to fail and scrape to recycle the stream.
+func (bo *backoffScrape) expireStream(gen uint64) {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	if bo.streamCancel != nil && bo.streamGen == gen {
+		bo.expired = true
+		bo.streamCancel()
+	}
+}
+
+// takeExpired reports whether the stream was canceled by expireStream.
+func (bo *backoffScrape) takeExpired() bool {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	expired := bo.expired
+	bo.expired = false
+	return expired
+}
+
+// waitPoll waits until PollInterval after the current poll started,
+// reporting false if the scraper is closed first.
+func (bo *backoffScrape) waitPoll() bool {
+	wait := bo.cfg.PollInterval - bo.since(bo.pollStartedAt)
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-bo.cfg.Clock.After(wait):
+		return true
+	case <-bo.ctx.Done():
+		return false
+	}
+}
+
+// recycle re-subscribes over the current connection once the stream reached
+// MaxStreamLifetime, or at the next poll once it reached PollWindow.
+func (bo *backoffScrape) recycle() (interface{}, error) {
+	if bo.cfg.Mode == ModePolling {
+		// The ended stream is kept until the next poll, so that the scraper
+		// counts as subscribed in between.
+		if !bo.waitPoll() {
+			return nil, bo.ctx.Err()
+		}
+	} else {
+		log.Info("Top SQL stream reached its max lifetime, re-subscribing", zap.Stringer("target", bo.component), zap.Duration("lifetime", bo.cfg.MaxStreamLifetime))
+	}
+	bo.lostStream()
+	bo.endStream()
+	return bo.reconnect(true)
+}
+
+func (bo *backoffScrape) reconnect(reuse bool) (interface{}, error) {
+	record := bo.backoffScrape(reuse)
+	if record == nil {
+		if bo.stopErr != nil {
+			return nil, bo.stopErr
+		}
+		return nil, bo.ctx.Err()
+	}
+	bo.track(record)
+	return record, nil
+}
+
+// streamEnded reports whether the target ended the stream for good, so that
+// scraping ends instead of reconnecting, unless
+// ScraperConfig.ReconnectOnStreamClose is set. A connection passed in by the
+// user cannot be re-established, so it ends once the stream ends regardless.
+func (bo *backoffScrape) streamEnded(err error) bool {
+	if bo.ctx.Err() != nil {
+		return false
+	}
+	if bo.cfg.Conn != nil && errors.Is(err, io.EOF) {
+		return true
+	}
+	return !bo.cfg.ReconnectOnStreamClose && isGracefulClose(err)
+}
+
+// isGracefulClose reports whether err is the target ending the stream on
+// purpose, i.e. io.EOF, or going away on a graceful shutdown, as opposed to
+// a transient failure.
+func isGracefulClose(err error) bool {
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Unavailable || isKeepaliveFailure(err) {
+		return false
+	}
+	return strings.Contains(st.Message(), "transport is closing") || strings.Contains(st.Message(), "received prior goaway")
+}
+
+// applyUpdate applies the config passed to UpdateConfig, if any.
+func (bo *backoffScrape) applyUpdate() {
+	if !bo.updated.Load() {
+		return
+	}
+	bo.updateMu.Lock()
+	defer bo.updateMu.Unlock()
+	copyTunables(&bo.cfg, bo.update)
+	bo.firstWaitTime.Store(bo.cfg.FirstWaitTime)
+	bo.update = nil
+	bo.updated.Store(false)
+	log.Info("Applied updated Top SQL scrape config", zap.Stringer("target", bo.component))
+}
+
+// outOfOrderTolerance is how much earlier than the previous one a record may
+// be without being counted as out of order. Records of a single report come
+// in no particular order and cover up to a minute, so their latest
+// timestamps differ within that.
+const outOfOrderTolerance = time.Minute
+
+func (bo *backoffScrape) track(record interface{}) {
+	bo.snapshot = bo.inSnapshot && record != nil
+	if bo.snapshot && bo.cfg.SnapshotComplete(record) {
+		bo.inSnapshot = false
+	}
+
+	ts, ok := rawRecordTimestamp(record)
+	if !ok {
+		return
+	}
+	if sec := ts.Unix(); sec > bo.resumeFrom.Load() {
+		bo.resumeFrom.Store(sec)
+	}
+
+	// TiDB and TiKV records of a mixed stream are ordered independently.
+	last := &bo.lastTiKVTimestamp
+	if _, ok := record.(*tipb.TopSQLSubResponse); ok {
+		last = &bo.lastTiDBTimestamp
+	}
+	if ts.Add(outOfOrderTolerance).Before(*last) {
+		bo.outOfOrder.Inc()
+		if !bo.outOfOrderLogged {
+			log.Warn("Top SQL record arrived out of time order",
+				zap.Stringer("target", bo.component),
+				zap.Time("timestamp", ts),
+				zap.Time("previous", *last))
+			bo.outOfOrderLogged = true
+		}
+	}
+	if ts.After(*last) {
+		*last = ts
+	}
+}
+
+// streamContext returns the context of a new stream, derived from the
+// scraper context and canceled along with the stream.
+func (bo *backoffScrape) streamContext() context.Context {
+	ctx, cancel := context.WithCancel(bo.ctx)
+	bo.mu.Lock()
+	bo.streamCancel = cancel
+	bo.streamGen++
+	gen := bo.streamGen
+	bo.mu.Unlock()
+
+	if bo.cfg.Mode == ModePolling {
+		// The window starts with Subscribe, whether records arrive or not.
+		bo.pollStartedAt = bo.cfg.Clock.Now()
+		bo.cfg.Clock.AfterFunc(bo.cfg.PollWindow, func() { bo.expireStream(gen) })
+	}
+
+	if bo.cfg.SubscribeContext != nil {
+		return bo.cfg.SubscribeContext(ctx)
+	}
+	return ctx
+}
+
+// cancelStream cancels the current stream only, which the scrape loop then
+// sees fail and re-establishes.
+func (bo *backoffScrape) cancelStream() {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	if bo.streamCancel != nil {
+		bo.reconnecting = true
+		bo.streamCancel()
+	}
+}
+
+// tidbSubRequest and tikvSubRequest build the subscribe requests sent on every
+// (re)connect. Neither request supports resuming from a timestamp yet, so data
+// produced while disconnected is lost. Once they do, fill in bo.resumeFrom
+// here to resubscribe from where the last stream left off.
+func (bo *backoffScrape) tidbSubRequest() *tipb.TopSQLSubRequest {
+	return &tipb.TopSQLSubRequest{}
+}
+
+func (bo *backoffScrape) tikvSubRequest() *resource_usage_agent.ResourceMeteringRequest {
+	return &resource_usage_agent.ResourceMeteringRequest{}
+}
+
+func recv(stream interface{}, pooled bool) (interface{}, error) {
+	switch s := stream.(type) {
+	case tipb.TopSQLPubSub_SubscribeClient:
+		if pooled {
+			return recvPooled(s, tidbRecordPool)
+		}
+		record, err := s.Recv()
+		if record == nil {
+			return nil, err
+		}
+		return record, nil
+	case resource_usage_agent.ResourceMeteringPubSub_SubscribeClient:
+		if pooled {
+			return recvPooled(s, tikvRecordPool)
+		}
+		record, err := s.Recv()
+		if record == nil {
+			return nil, err
+		}
+		return record, nil
+	case *mixedStream:
+		return s.Recv()
+	}
+	return nil, nil
+}
+
+// backoffScrape reconnects to the target, starting with subscribing over the
+// current connection if reuse is set.
+func (bo *backoffScrape) backoffScrape(reuse bool) (record interface{}) {
+	// A target may accept the connection but end the stream immediately, so
+	// make sure full reconnect cycles are not run back to back.
+	if wait := bo.cfg.MinReconnectInterval - bo.since(bo.lastReconnect); wait > 0 {
+		select {
+		case <-bo.cfg.Clock.After(wait):
+		case <-bo.ctx.Done():
+			return
+		}
+	}
+	bo.lastReconnect = bo.cfg.Clock.Now()
+	if bo.subscribeSuccesses.Load() > 0 && bo.ctx.Err() == nil {
+		bo.reconnects.Inc()
+	}
+
+	if bo.cfg.AdaptiveBackoff && !bo.subscribedAt.IsZero() && bo.since(bo.subscribedAt) >= adaptiveStablePeriod {
+		bo.adaptFirstWaitTime(0.5)
+	}
+	lastRetried := uint(0)
+	defer func() {
+		if bo.cfg.AdaptiveBackoff && (record == nil || lastRetried >= adaptiveFailureRetries) {
+			bo.adaptFirstWaitTime(2)
+		}
+	}()
+
+	bo.dialFailures = 0
+	bo.subscribeFailures = 0
+	bo.dialRetried.Store(0)
+	bo.subscribeRetried.Store(0)
+	bo.stopErr = nil
+
+	// Dial and subscribe failures have separate budgets, so the retry loop
+	// allows both to be used up and is stopped by fail once either is.
+	maxRetryTimes := bo.cfg.MaxRetryTimes + bo.subscribeRetryTimes()
+	firstWaitTime := bo.firstWaitTime.Load()
+	utils.WithRetryBackoffClock(bo.ctx, bo.cfg.Clock, maxRetryTimes, firstWaitTime, maxWaitTime(firstWaitTime), func(retried uint) bool {
+		lastRetried = retried
+		bo.retried.Store(uint32(retried))
+		bo.subscribeAttempts.Inc()
+		bo.metrics.subscribeAttempts.Inc()
+
+		var conn *grpc.ClientConn
+		if reuse {
+			bo.mu.Lock()
+			conn = bo.conn
+			bo.mu.Unlock()
+			reuse = false
+		}
+		if conn == nil {
+			bo.close()
+			var err error
+			if conn, err = bo.dial(); err != nil {
+				bo.dialFailures++
+				bo.metrics.dialFailures.Inc()
+				bo.setState(false, err)
+				if bo.fail("Failed to dial Top SQL scrape target", err) {
+					return true
+				}
+				bo.dialRetried.Inc()
+				return false
+			}
+
+			bo.mu.Lock()
+			bo.conn = conn
+			bo.mu.Unlock()
+			if bo.cfg.OnConnect != nil {
+				bo.cfg.OnConnect(bo.component)
+			}
+			bo.setState(true, nil)
+		}
+
+		var err error
+		record, err = bo.subscribe(conn)
+		if errors.Is(err, ErrUnknownComponentKind) {
+			// Retrying cannot help.
+			bo.stopErr = err
+			bo.closeWith(err)
+			return true
+		}
+		if err != nil {
+			bo.subscribeFailures++
+			switch bo.decide(err) {
+			case RetryDecisionAbort:
+				bo.abort("Failed to call Top SQL Subscribe", err)
+				bo.closeWith(err)
+				return true
+			case RetryDecisionRetry:
+				if stop := bo.fail("Failed to call Top SQL Subscribe", err); !stop {
+					bo.subscribeRetried.Inc()
+					bo.endStream()
+					reuse = true
+					return false
+				}
+			default:
+				bo.fail("Failed to call Top SQL Subscribe", err)
+			}
+			bo.failover()
+			bo.closeWith(err)
+			if bo.stopErr != nil {
+				return true
+			}
+			bo.subscribeRetried.Inc()
+			return false
+		}
+
+		bo.subscribed()
+		version := bo.readServerVersion(record)
+		log.Info("Connected to Top SQL scrape target",
+			zap.Stringer("target", bo.component),
+			zap.String("addr", bo.connected.Load()),
+			zap.Duration("dial_duration", bo.lastDialDuration.Load()),
+			zap.String("server_version", version))
+		return true
+	})
+	if record == nil && bo.stopErr == nil && bo.ctx.Err() == nil {
+		bo.stopErr = ErrRetryExhausted
+	}
+
+	return
+}
+
+// subscribe subscribes to the target over conn, returning the first record.
+// A stream failing before its first record is re-subscribed over the same
+// connection up to FirstRecvRetryTimes times, before the connection is given
+// up.
+func (bo *backoffScrape) subscribe(conn *grpc.ClientConn) (interface{}, error) {
+	for attempt := uint(0); ; {
+		stream, err := bo.open(conn)
+		if err != nil {
+			return nil, err
+		}
+		record, err := bo.recvFirst(stream)
+		if record != nil || err == nil {
+			return record, err
+		}
+		if bo.takeExpired() {
+			// The poll ended without a record, which is no failure.
+			bo.endStream()
+			if !bo.waitPoll() {
+				return nil, bo.ctx.Err()
+			}
+			continue
+		}
+		bo.readTrailer(stream)
+		if bo.compressor() != "" && isCompressionRejected(err) {
+			log.Warn("Top SQL scrape target rejected the compressor, subscribing uncompressed",
+				zap.Stringer("target", bo.component), zap.String("compressor", bo.cfg.Compressor), zap.Error(err))
+			bo.uncompressed.Store(true)
+			bo.endStream()
+			continue
+		}
+		if attempt >= bo.cfg.FirstRecvRetryTimes || bo.ctx.Err() != nil {
+			return nil, err
+		}
+		log.Info("Top SQL stream failed before the first record, subscribing again", zap.Stringer("target", bo.component), zap.Error(err))
+		bo.endStream()
+		attempt++
+	}
+}
+
+// recvFirst receives the first record of a new stream. Unlike the later ones
+// received by scrape, a first record not received within RecvTimeout only
+// cancels the stream, as the connection is still being set up.
+func (bo *backoffScrape) recvFirst(stream interface{}) (interface{}, error) {
+	if bo.cfg.RecvTimeout <= 0 {
+		return recv(stream, false)
+	}
+	var timedOut atomic.Bool
+	stop := bo.cfg.Clock.AfterFunc(bo.cfg.RecvTimeout, func() {
+		timedOut.Store(true)
+		bo.mu.Lock()
+		if bo.streamCancel != nil {
+			bo.streamCancel()
+		}
+		bo.mu.Unlock()
+	})
+	record, err := recv(stream, false)
+	stop()
+	if record == nil && timedOut.Load() {
+		return nil, errRecvTimeout
+	}
+	return record, err
+}
+
+// compressor returns the compressor to subscribe with, if any.
+func (bo *backoffScrape) compressor() string {
+	if bo.uncompressed.Load() {
+		return ""
+	}
+	return bo.cfg.Compressor
+}
+
+func (bo *backoffScrape) callOptions() []grpc.CallOption {
+	if name := bo.compressor(); name != "" {
+		return []grpc.CallOption{grpc.UseCompressor(name)}
+	}
+	return nil
+}
+
+// isCompressionRejected reports whether err is a target failing to decompress
+// a request, as it does not support the compressor.
+func isCompressionRejected(err error) bool {
+	st := status.Convert(err)
+	msg := strings.ToLower(st.Message())
+	return st.Code() == codes.Unimplemented && (strings.Contains(msg, "grpc-encoding") || strings.Contains(msg, "compress"))
+}
+
+// newTiDBClient and newTiKVClient create the pub-sub clients streams are
+// opened with, replaced by tests to emulate misbehaving clients.
+var (
+	newTiDBClient = tipb.NewTopSQLPubSubClient
+	newTiKVClient = resource_usage_agent.NewResourceMeteringPubSubClient
+)
+
+// open opens a stream over conn, set as the current one.
+func (bo *backoffScrape) open(conn *grpc.ClientConn) (interface{}, error) {
+	ctx := bo.streamContext()
+	switch bo.component.Kind {
+	case utils.ComponentTiDB:
+		client := newTiDBClient(conn)
+		stream, err := client.Subscribe(ctx, bo.tidbSubRequest(), bo.callOptions()...)
+		if err == nil && stream == nil {
+			err = errNilStream
+		}
+		if err != nil {
+			return nil, err
+		}
+		bo.setStream(client, stream)
+		return stream, nil
+
+	case utils.ComponentTiKV, utils.ComponentTiFlash:
+		client := newTiKVClient(conn)
+		stream, err := client.Subscribe(ctx, bo.tikvSubRequest(), bo.callOptions()...)
+		if err == nil && stream == nil {
+			err = errNilStream
+		}
+		if err != nil {
+			return nil, err
+		}
+		bo.setStream(client, stream)
+		return stream, nil
+
+	case utils.ComponentTiDBTiKV:
+		// Both subscriptions share the connection and the stream context,
+		// so they are canceled together.
+		tidbStream, err := newTiDBClient(conn).Subscribe(ctx, bo.tidbSubRequest(), bo.callOptions()...)
+		if err == nil && tidbStream == nil {
+			err = errNilStream
+		}
+		if err != nil {
+			return nil, err
+		}
+		tikvStream, err := newTiKVClient(conn).Subscribe(ctx, bo.tikvSubRequest(), bo.callOptions()...)
+		if err == nil && tikvStream == nil {
+			err = errNilStream
+		}
+		if err != nil {
+			return nil, err
+		}
+		stream := newMixedStream(tidbStream, tikvStream)
+		bo.setStream(nil, stream)
+		return stream, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownComponentKind, bo.component.Kind)
+}
+
+func (bo *backoffScrape) subscribeRetryTimes() uint {
+	if bo.cfg.MaxSubscribeRetryTimes > 0 {
+		return bo.cfg.MaxSubscribeRetryTimes
+	}
+	return bo.cfg.MaxRetryTimes
+}
+
+// fail logs a failed attempt and reports whether to give up, because the
+// retry budget of the failed stage is used up.
+func (bo *backoffScrape) fail(msg string, err error) bool {
+	switch {
+	case bo.dialFailures > bo.cfg.MaxRetryTimes:
+		bo.stopErr = ErrDialRetryExhausted
+	case bo.subscribeFailures > bo.subscribeRetryTimes():
+		bo.stopErr = ErrSubscribeRetryExhausted
+	}
+	bo.logFailure(msg, err)
+	if wait, ok := bo.nextWait(); ok {
+		backoffWaitGauge.With(metricLabels(bo.component, bo.cfg.SessionID)).Set(wait.Seconds())
+	}
+	return bo.stopErr != nil
+}
+
+// decide applies the retry policy to a failed Subscribe or Recv. Failures
+// caused by the scraper being closed always reconnect, which ends scraping.
+func (bo *backoffScrape) decide(err error) RetryDecision {
+	if err == nil || bo.ctx.Err() != nil {
+		return RetryDecisionReconnect
+	}
+	policy := bo.cfg.RetryPolicy
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+	return policy(status.Code(err))
+}
+
+// abort logs a failure the retry policy decided to stop scraping on.
+func (bo *backoffScrape) abort(msg string, err error) {
+	bo.stopErr = fmt.Errorf("%w: %v", ErrAborted, err)
+	bo.logFailure(msg, err)
+}
+
+const (
+	// adaptiveStablePeriod is how long a subscription must have lasted for
+	// the next reconnect to start with a shorter wait.
+	adaptiveStablePeriod = 5 * time.Minute
+	// adaptiveFailureRetries is the number of retries within a reconnect
+	// after which later reconnects start with a longer wait.
+	adaptiveFailureRetries = 3
+	// adaptiveFactor bounds the adapted wait to [1/adaptiveFactor,
+	// adaptiveFactor] times ScraperConfig.FirstWaitTime.
+	adaptiveFactor = 8
+)
+
+// nextWait returns the wait before the next retry of the current reconnect,
+// or false if the current attempt is the last one.
+func (bo *backoffScrape) nextWait() (time.Duration, bool) {
+	if bo.stopErr != nil {
+		return 0, false
+	}
+	retried := uint(bo.retried.Load())
+	return retryWait(bo.firstWaitTime.Load(), retried), true
+}
+
+// maxRetryWait caps the doubling wait between retries, which would
+// otherwise overflow with large retry budgets. A first wait time above it is
+// kept as is.
+const maxRetryWait = 5 * time.Minute
+
+func maxWaitTime(firstWaitTime time.Duration) time.Duration {
+	if firstWaitTime > maxRetryWait {
+		return firstWaitTime
+	}
+	return maxRetryWait
+}
+
+// retryWait returns the wait after the given number of retries, as waited by
+// utils.WithRetryBackoffClock.
+func retryWait(firstWaitTime time.Duration, retried uint) time.Duration {
+	max := maxWaitTime(firstWaitTime)
+	wait := firstWaitTime
+	for ; retried > 0 && wait < max; retried-- {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+func (bo *backoffScrape) since(t time.Time) time.Duration {
+	return bo.cfg.Clock.Now().Sub(t)
+}
+
+func (bo *backoffScrape) subscribed() {
+	now := bo.cfg.Clock.Now()
+	bo.streamUpAt.Store(now.UnixNano())
+	if lostAt := bo.streamLostAt.Swap(0); lostAt != 0 {
+		bo.downtime.Add(now.UnixNano() - lostAt)
+	}
+	bo.subscribeSuccesses.Inc()
+	bo.metrics.subscriptions.Inc()
+	bo.metrics.connected.Set(1)
+	bo.metrics.firstRecord.Observe(now.Sub(bo.lastReconnect).Seconds())
+	backoffWaitGauge.With(metricLabels(bo.component, bo.cfg.SessionID)).Set(0)
+
+	// A new stream may legitimately start before where the last one ended.
+	bo.lastTiDBTimestamp, bo.lastTiKVTimestamp = time.Time{}, time.Time{}
+	bo.outOfOrderLogged = false
+	bo.inSnapshot = bo.cfg.SnapshotComplete != nil
+	bo.retried.Store(0)
+	bo.dialRetried.Store(0)
+	bo.subscribeRetried.Store(0)
+	bo.consecutiveFailures = 0
+	bo.subscribedAt = now
+}
+
+func (bo *backoffScrape) adaptFirstWaitTime(factor float64) {
+	wait := time.Duration(float64(bo.firstWaitTime.Load()) * factor)
+	if min := bo.cfg.FirstWaitTime / adaptiveFactor; wait < min {
+		wait = min
+	}
+	if max := bo.cfg.FirstWaitTime * adaptiveFactor; wait > max {
+		wait = max
+	}
+	bo.firstWaitTime.Store(wait)
+}
+
+// logFailure logs a failed connection attempt. Failures caused by the
+// connection being closed locally, e.g. by Close or Reconnect racing with an
+// in-flight dial or Recv, are expected and only logged at debug level.
+//
+// The first failure after a successful subscription is logged as a warning,
+// while consecutive ones are logged at ScraperConfig.RetryLogLevel. Failures
+// within the startup grace period before the first subscription are only
+// logged at debug level, unless the scraper is giving up.
+func (bo *backoffScrape) logFailure(msg string, err error) {
+	if bo.ctx.Err() != nil || errors.Is(err, grpc.ErrClientConnClosing) || status.Code(err) == codes.Canceled {
+		log.Debug(msg, zap.Stringer("target", bo.component), zap.Error(err))
+		return
+	}
+
+	bo.lastErr.Store(err)
+	bo.consecutiveFailures++
+	if bo.consecutiveFailures == 1 {
+		bo.failingSince = bo.cfg.Clock.Now()
+	}
+	wait, ok := bo.nextWait()
+	level := zapcore.WarnLevel
+	switch {
+	case ok && bo.subscribeSuccesses.Load() == 0 && bo.since(bo.createdAt) < bo.cfg.StartupGracePeriod:
+		// The target may just not be up yet.
+		level = zapcore.DebugLevel
+	case bo.consecutiveFailures > 1:
+		level = bo.cfg.RetryLogLevel
+	}
+	ce := log.L().Check(level, msg)
+	if ce == nil {
+		return
+	}
+	suppressed := 0
+	if ok {
+		n, allowed := bo.failureLogs.tick(bo.cfg.Clock.Now())
+		if !allowed || !failureLogs.allow() {
+			return
+		}
+		suppressed = n - 1
+	}
+	fields := []zap.Field{
+		zap.Stringer("target", bo.component),
+		zap.Int("consecutive_failures", bo.consecutiveFailures),
+		zap.Duration("failing_for", bo.since(bo.failingSince)),
+	}
+	if suppressed > 0 {
+		fields = append(fields, zap.Int("suppressed", suppressed))
+	}
+	if ok {
+		fields = append(fields, zap.Duration("next_retry_in", wait))
+	} else {
+		fields = append(fields, zap.Bool("giving_up", true))
+	}
+	ce.Write(append(fields, zap.Error(err))...)
+}
+
+// isKeepaliveFailure reports whether err is caused by the transport being
+// closed after keepalive pings went unacknowledged, i.e. a half-open
+// connection rather than the server ending the stream.
+func isKeepaliveFailure(err error) bool {
+	st, ok := status.FromError(err)
+	return ok && st.Code() == codes.Unavailable && strings.Contains(st.Message(), "keepalive ping failed")
+}
+
+func (bo *backoffScrape) tlsConfig() *tls.Config {
+	bo.updateMu.Lock()
+	defer bo.updateMu.Unlock()
+	return bo.tlsCfg
+}
+
+func (bo *backoffScrape) dial() (*grpc.ClientConn, error) {
+	if bo.cfg.dialLimiter != nil {
+		select {
+		case bo.cfg.dialLimiter <- struct{}{}:
+			defer func() { <-bo.cfg.dialLimiter }()
+		case <-bo.ctx.Done():
+			return nil, bo.ctx.Err()
+		}
+	}
+	tlsCfg := bo.tlsConfig()
+	bo.encrypted.Store(tlsCfg != nil)
+
+	// Try every address once, starting with the one dialed last.
+	var err error
+	for range bo.addrs {
+		addr := bo.addrs[bo.addrIndex]
+		start := bo.cfg.Clock.Now()
+		var conn *grpc.ClientConn
+		if conn, err = bo.dialAddr(tlsCfg, addr); err == nil {
+			elapsed := bo.since(start)
+			bo.lastDialDuration.Store(elapsed)
+			bo.totalDialDuration.Add(elapsed)
+			bo.dials.Inc()
+			bo.connected.Store(addr)
+			connectedEndpointGauge.With(endpointLabels(bo.component, bo.cfg.SessionID, addr)).Set(1)
+			return conn, nil
+		}
+		if len(bo.addrs) == 1 || bo.ctx.Err() != nil {
+			break
+		}
+		log.Info("Failed to dial Top SQL scrape target address, failing over",
+			zap.Stringer("target", bo.component), zap.String("addr", addr), zap.Error(err))
+		bo.failover()
+	}
+	return nil, err
+}
+
+// dialAddr connects to addr via ClientConnFactory if set, or dials it.
+func (bo *backoffScrape) dialAddr(tlsCfg *tls.Config, addr string) (*grpc.ClientConn, error) {
+	if bo.cfg.ClientConnFactory == nil {
+		return dial(bo.ctx, tlsCfg, addr, bo.cfg, bo.dialOpts...)
+	}
+	ctx, cancel := context.WithTimeout(bo.ctx, bo.cfg.DialTimeout)
+	defer cancel()
+	conn, err := bo.cfg.ClientConnFactory(ctx, addr)
+	if err == nil && conn == nil {
+		err = errNilConn
+	}
+	return conn, err
+}
+
+// failover makes the next dial start with the next address.
+func (bo *backoffScrape) failover() {
+	bo.addrIndex = (bo.addrIndex + 1) % len(bo.addrs)
+}
+
+// currentAddr returns the address connected to, or the one to dial next if
+// there is no connection.
+func (bo *backoffScrape) currentAddr() string {
+	if addr := bo.connected.Load(); addr != "" {
+		return addr
+	}
+	return bo.addrs[0]
+}
+
+func (bo *backoffScrape) setStream(client interface{}, stream interface{}) {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	bo.client = client
+	bo.stream = stream
+}
+
+// serverVersionKeys are the header metadata keys a server may advertise its
+// version with, in order of preference.
+var serverVersionKeys = []string{"server-version", "x-server-version", "version"}
+
+// readServerVersion reads the version advertised by the server in the header
+// metadata of the current stream, or "unknown" if there is none. Neither TiDB
+// nor TiKV advertises it so far.
+func (bo *backoffScrape) readServerVersion(first interface{}) string {
+	md := bo.readHeader(first)
+	version := "unknown"
+	if v := firstHeaderValue(md, serverVersionKeys); v != "" {
+		version = v
+	}
+	bo.serverVersion.Store(version)
+	return version
+}
+
+// readHeader returns the header metadata of the current stream, passing it
+// to OnHeader.
+func (bo *backoffScrape) readHeader(first interface{}) metadata.MD {
+	bo.mu.Lock()
+	var stream grpc.ClientStream
+	switch s := bo.stream.(type) {
+	case grpc.ClientStream:
+		stream = s
+	case *mixedStream:
+		// Only the stream of the first record is known to have sent its
+		// header, while waiting for the other one could block.
+		if _, ok := first.(*tipb.TopSQLSubResponse); ok {
+			stream = s.streams[0]
+		} else {
+			stream = s.streams[1]
+		}
+	}
+	bo.mu.Unlock()
+
+	if stream == nil {
+		return nil
+	}
+	// The header has arrived along with the first record.
+	md, err := stream.Header()
+	if err != nil {
+		return nil
+	}
+	if bo.cfg.OnHeader != nil {
+		bo.cfg.OnHeader(bo.component, md)
+	}
+	return md
+}
+
+// readTrailer passes the trailer metadata of a failed stream to OnTrailer.
+func (bo *backoffScrape) readTrailer(stream interface{}) {
+	if bo.cfg.OnTrailer == nil {
+		return
+	}
+	var s grpc.ClientStream
+	switch st := stream.(type) {
+	case grpc.ClientStream:
+		s = st
+	case *mixedStream:
+		s = st.failedStream()
+	}
+	if s != nil {
+		bo.cfg.OnTrailer(bo.component, s.Trailer())
+	}
+}
+
+func firstHeaderValue(md metadata.MD, keys []string) string {
+	for _, key := range keys {
+		if values := md.Get(key); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// lostStream accounts the uptime of the current stream, which failed.
+func (bo *backoffScrape) lostStream() {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	bo.lostStreamLocked()
+}
+
+func (bo *backoffScrape) lostStreamLocked() {
+	if now := bo.cfg.Clock.Now().UnixNano(); bo.stream != nil && bo.streamLostAt.CAS(0, now) {
+		bo.uptime.Add(now - bo.streamUpAt.Load())
+	}
+}
+
+// endStream ends the current stream, keeping the connection.
+func (bo *backoffScrape) endStream() {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	if bo.streamCancel != nil {
+		bo.streamCancel()
+		bo.streamCancel = nil
+	}
+	if m, ok := bo.stream.(*mixedStream); ok {
+		m.close()
+	}
+	bo.client = nil
+	bo.stream = nil
+}
+
+func (bo *backoffScrape) close() {
+	bo.closeWith(nil)
+}
+
+// closeWith tears down the current connection, reporting err as the cause of
+// the disconnection.
+func (bo *backoffScrape) closeWith(err error) {
+	bo.mu.Lock()
+	if bo.streamCancel != nil {
+		bo.streamCancel()
+		bo.streamCancel = nil
+	}
+	if bo.reconnecting {
+		// A stream canceled by Reconnect fails with a cancellation, while it
+		// is a deliberate close.
+		err = nil
+		bo.reconnecting = false
+	}
+	bo.expired = false
+	closed := bo.conn != nil
+	bo.lostStreamLocked()
+	if closed {
+		if m, ok := bo.stream.(*mixedStream); ok {
+			m.close()
+		}
+		if !bo.cfg.SharedClientConn || bo.cfg.ClientConnFactory == nil {
+			_ = bo.conn.Close()
+		}
+		bo.conn = nil
+		bo.metrics.connected.Set(0)
+		connectedEndpointGauge.Delete(endpointLabels(bo.component, bo.cfg.SessionID, bo.connected.Load()))
+		bo.connected.Store("")
+		bo.client = nil
+		bo.stream = nil
+	}
+	bo.mu.Unlock()
+
+	if err != nil && bo.ctx.Err() == nil {
+		bo.lastErr.Store(err)
+	}
+	if closed && isKeepaliveFailure(err) {
+		if failureLogs.allow() {
+			log.Warn("Top SQL scrape target did not acknowledge keepalive pings, connection is dead", zap.Stringer("target", bo.component), zap.Error(err))
+		}
+		bo.keepaliveDisconnects.Inc()
+		keepaliveDisconnectsCounter.With(metricLabels(bo.component, bo.cfg.SessionID)).Inc()
+	}
+	if closed && bo.cfg.OnDisconnect != nil {
+		bo.cfg.OnDisconnect(bo.component, err)
+	}
+	if closed {
+		bo.setState(false, err)
+	}
+}
+
+const (
+	stateUnknown int32 = iota
+	stateConnected
+	stateDisconnected
+)
+
+// setState invokes OnStateChange if the connection state changes, which it
+// does for the first dial as well, whether it succeeds or fails.
+func (bo *backoffScrape) setState(connected bool, err error) {
+	state := stateDisconnected
+	if connected {
+		state = stateConnected
+	}
+	if prev := bo.state.Swap(state); prev != state && bo.cfg.OnStateChange != nil {
+		bo.cfg.OnStateChange(bo.component, connected, err)
 	}
 }
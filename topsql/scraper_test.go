@@ -0,0 +1,766 @@
+package topsql_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/atomic"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/breeswish/mockngm/topsql"
+	"github.com/breeswish/mockngm/topsql/topsqltest"
+	"github.com/breeswish/mockngm/utils"
+)
+
+// waitTimeout bounds every wait of the tests, so that a broken scraper fails
+// the test instead of hanging it.
+const waitTimeout = 5 * time.Second
+
+func newServer(t testing.TB, cfg topsqltest.Config) *topsqltest.Server {
+	srv := topsqltest.NewServer(cfg)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newScraper creates a scraper of the given kind connected to srv, closed
+// when the test ends. The address is never dialed.
+func newScraper(t testing.TB, kind utils.ComponentKind, srv *topsqltest.Server, opts ...topsql.Option) *topsql.Scraper {
+	opts = append([]topsql.Option{topsql.WithContextDialer(srv.Dialer())}, opts...)
+	s := topsql.NewScraper(context.Background(), utils.Component{Kind: kind, Addr: "127.0.0.1:10080"}, nil, opts...)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// run runs the scraper in the background, returning the error of Run.
+func run(s *topsql.Scraper) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run()
+	}()
+	return errCh
+}
+
+func waitRun(t testing.TB, errCh <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for Run to return")
+		return nil
+	}
+}
+
+// waitFor polls cond until it holds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// recorder is a RecordHandler keeping the records it handles.
+type recorder struct {
+	mu      sync.Mutex
+	records []topsql.ScrapedRecord
+}
+
+func (r *recorder) handle(record topsql.ScrapedRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, record)
+	return nil
+}
+
+func (r *recorder) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.records)
+}
+
+func (r *recorder) get() []topsql.ScrapedRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]topsql.ScrapedRecord(nil), r.records...)
+}
+
+func TestScraperDeliversRecords(t *testing.T) {
+	tidbRecord := &tipb.TopSQLSubResponse{
+		RespOneof: &tipb.TopSQLSubResponse_Record{
+			Record: &tipb.TopSQLRecord{
+				SqlDigest:  []byte("sql"),
+				PlanDigest: []byte("plan"),
+				Items:      []*tipb.TopSQLRecordItem{{TimestampSec: 1, CpuTimeMs: 10, StmtExecCount: 2}},
+			},
+		},
+	}
+	tikvRecord := &resource_usage_agent.ResourceUsageRecord{
+		RecordOneof: &resource_usage_agent.ResourceUsageRecord_Record{
+			Record: &resource_usage_agent.GroupTagRecord{
+				ResourceGroupTag: []byte("tag"),
+				Items:            []*resource_usage_agent.GroupTagRecordItem{{TimestampSec: 1, CpuTimeMs: 10, ReadKeys: 3}},
+			},
+		},
+	}
+	for _, tc := range []struct {
+		kind   utils.ComponentKind
+		record topsql.ScrapedRecord
+	}{
+		{utils.ComponentTiDB, topsql.ScrapedRecord{TiDB: tidbRecord}},
+		{utils.ComponentTiKV, topsql.ScrapedRecord{TiKV: tikvRecord}},
+	} {
+		t.Run(string(tc.kind), func(t *testing.T) {
+			srv := newServer(t, topsqltest.Config{TiDBRecord: tidbRecord, TiKVRecord: tikvRecord, Count: 3})
+			var r recorder
+			s := newScraper(t, tc.kind, srv, topsql.WithHandler(r.handle))
+			if err := waitRun(t, run(s)); err != nil {
+				t.Fatalf("Run() = %v, want nil once the stream is ended", err)
+			}
+
+			want := []topsql.ScrapedRecord{tc.record, tc.record, tc.record}
+			for i := range want {
+				want[i].Component = utils.Component{Kind: tc.kind, Addr: "127.0.0.1:10080"}
+			}
+			if diff := topsqltest.DiffRecords(r.get(), want); diff != "" {
+				t.Errorf("records mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestScraperReconnectsAfterStreamFails(t *testing.T) {
+	srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+	var r recorder
+	s := newScraper(t, utils.ComponentTiDB, srv, topsql.WithHandler(r.handle))
+	errCh := run(s)
+
+	waitFor(t, "the first record", func() bool { return r.len() > 0 })
+	srv.EndStreams(status.Error(codes.Unavailable, "connection dropped"))
+	waitFor(t, "a second subscription", func() bool { return srv.Subscriptions() >= 2 })
+	n := r.len()
+	waitFor(t, "records after reconnecting", func() bool { return r.len() > n })
+	if got := s.Status().ReconnectCount; got == 0 {
+		t.Errorf("ReconnectCount = 0, want the reconnect counted")
+	}
+
+	s.Close()
+	if err := waitRun(t, errCh); err != nil {
+		t.Errorf("Run() = %v, want nil once closed", err)
+	}
+}
+
+func TestScraperStreamClosedByTarget(t *testing.T) {
+	t.Run("ends", func(t *testing.T) {
+		srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+		var r recorder
+		s := newScraper(t, utils.ComponentTiKV, srv, topsql.WithHandler(r.handle))
+		errCh := run(s)
+
+		waitFor(t, "the first record", func() bool { return r.len() > 0 })
+		srv.EndStreams(nil)
+		if err := waitRun(t, errCh); err != nil {
+			t.Errorf("Run() = %v, want nil", err)
+		}
+		if got := srv.Subscriptions(); got != 1 {
+			t.Errorf("Subscriptions() = %d, want 1", got)
+		}
+		if got := s.DownReason(); !errors.Is(got, topsql.ErrFinished) {
+			t.Errorf("DownReason() = %v, want ErrFinished", got)
+		}
+	})
+	t.Run("reconnects", func(t *testing.T) {
+		srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+		var r recorder
+		s := newScraper(t, utils.ComponentTiKV, srv, topsql.WithHandler(r.handle), topsql.WithReconnectOnStreamClose(true))
+		run(s)
+
+		waitFor(t, "the first record", func() bool { return r.len() > 0 })
+		srv.EndStreams(nil)
+		waitFor(t, "a second subscription", func() bool { return srv.Subscriptions() >= 2 })
+	})
+}
+
+func TestScraperCloseWhileRecvBlocked(t *testing.T) {
+	// The server never sends a record, so the scraper is blocked in Recv.
+	srv := newServer(t, topsqltest.Config{FirstRecordDelay: time.Hour})
+	s := newScraper(t, utils.ComponentTiDB, srv)
+	errCh := run(s)
+	waitFor(t, "the subscription", func() bool { return srv.Subscriptions() == 1 })
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(waitTimeout):
+		t.Fatal("Close did not return while Recv was blocked")
+	}
+	if err := waitRun(t, errCh); err != nil {
+		t.Errorf("Run() = %v, want nil once closed", err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Error("Done() is not closed after Close returned")
+	}
+}
+
+func TestScraperConcurrentAccess(t *testing.T) {
+	srv := newServer(t, topsqltest.Config{Interval: time.Millisecond})
+	var r recorder
+	s := newScraper(t, utils.ComponentTiDB, srv, topsql.WithHandler(r.handle), topsql.WithMinReconnectInterval(0))
+	errCh := run(s)
+	waitFor(t, "the first record", func() bool { return r.len() > 0 })
+
+	// Run with -race, so that unsynchronized access by the getters and the
+	// scrape loop is reported.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, f := range []func(){
+		func() { _ = s.Stats() },
+		func() { _ = s.Status() },
+		func() { _ = s.Health() },
+		func() { _ = s.Config() },
+		func() { _ = s.DialSettings() },
+		func() {
+			s.Reconnect()
+			time.Sleep(20 * time.Millisecond)
+		},
+	} {
+		wg.Add(1)
+		go func(f func()) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					f()
+				}
+			}
+		}(f)
+	}
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	waitFor(t, "a reconnect by Reconnect", func() bool { return srv.Subscriptions() >= 2 })
+	n := r.len()
+	waitFor(t, "records after the last reconnect", func() bool { return r.len() > n })
+	s.Close()
+	if err := waitRun(t, errCh); err != nil {
+		t.Errorf("Run() = %v, want nil once closed", err)
+	}
+}
+
+func TestScraperCloseLeavesNoGoroutines(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	srv := topsqltest.NewServer(topsqltest.Config{Interval: 10 * time.Millisecond})
+	defer srv.Close()
+	var r recorder
+	s := topsql.NewScraper(context.Background(), utils.Component{Kind: utils.ComponentTiDB, Addr: "127.0.0.1:10080"}, nil,
+		topsql.WithContextDialer(srv.Dialer()), topsql.WithHandler(r.handle))
+	errCh := run(s)
+	waitFor(t, "a record", func() bool { return r.len() > 0 })
+	s.Close()
+	if err := waitRun(t, errCh); err != nil {
+		t.Errorf("Run() = %v, want nil once closed", err)
+	}
+}
+
+func BenchmarkScrape(b *testing.B) {
+	for _, kind := range []utils.ComponentKind{utils.ComponentTiDB, utils.ComponentTiKV} {
+		b.Run(string(kind), func(b *testing.B) {
+			// The server ends the stream after b.N records, which ends Run.
+			srv := newServer(b, topsqltest.Config{Count: b.N})
+			s := newScraper(b, kind, srv,
+				topsql.WithHandler(func(topsql.ScrapedRecord) error { return nil }),
+				topsql.WithRecordLogLevel(zapcore.DebugLevel))
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			if err := s.Run(); err != nil {
+				b.Fatalf("Run() = %v", err)
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "records/s")
+			if got := s.Stats().Records; got != uint64(b.N) {
+				b.Fatalf("received %d records, want %d", got, b.N)
+			}
+		})
+	}
+}
+
+func TestScraperMinReconnectInterval(t *testing.T) {
+	const interval = time.Second
+	clock := topsqltest.NewClock(time.Now())
+	// Every stream ends right after its first record.
+	srv := newServer(t, topsqltest.Config{Count: 1})
+	s := newScraper(t, utils.ComponentTiDB, srv,
+		topsql.WithClock(clock),
+		topsql.WithReconnectOnStreamClose(true),
+		topsql.WithMinReconnectInterval(interval))
+	run(s)
+
+	for i := 1; i <= 3; i++ {
+		waitFor(t, "the subscription", func() bool { return srv.Subscriptions() == i })
+		waitFor(t, "the reconnect to wait", func() bool { return clock.Timers() > 0 })
+		clock.Advance(interval - time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		if got := srv.Subscriptions(); got != i {
+			t.Fatalf("Subscriptions() = %d before the interval elapsed, want %d", got, i)
+		}
+		clock.Advance(time.Millisecond)
+	}
+	waitFor(t, "the last subscription", func() bool { return srv.Subscriptions() == 4 })
+}
+
+// panickingHandler panics on the first record and records the others.
+type panickingHandler struct {
+	recorder
+	calls atomic.Int32
+}
+
+func (h *panickingHandler) handle(record topsql.ScrapedRecord) error {
+	if h.calls.Inc() == 1 {
+		panic("broken handler")
+	}
+	return h.recorder.handle(record)
+}
+
+func TestScraperHandlerPanic(t *testing.T) {
+	t.Run("recovers", func(t *testing.T) {
+		srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+		var h panickingHandler
+		s := newScraper(t, utils.ComponentTiDB, srv, topsql.WithHandler(h.handle))
+		run(s)
+
+		waitFor(t, "records after the panic", func() bool { return h.len() >= 2 })
+		_, err := s.LastErrorRecord()
+		if err == nil || !strings.Contains(err.Error(), "broken handler") {
+			t.Errorf("LastErrorRecord() error = %v, want the panic", err)
+		}
+		if s.IsDown() {
+			t.Error("scraper stopped after the handler panicked")
+		}
+	})
+	t.Run("stops", func(t *testing.T) {
+		srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+		var h panickingHandler
+		s := newScraper(t, utils.ComponentTiDB, srv, topsql.WithHandler(h.handle), topsql.WithStopOnHandlerPanic(true))
+		if err := waitRun(t, run(s)); err != nil {
+			t.Errorf("Run() = %v, want nil", err)
+		}
+		if got := s.DownReason(); !errors.Is(got, topsql.ErrClosed) {
+			t.Errorf("DownReason() = %v, want ErrClosed", got)
+		}
+		if got := h.len(); got != 0 {
+			t.Errorf("%d records handled after the panic, want 0", got)
+		}
+	})
+}
+
+type tenantKey struct{}
+
+func TestScraperSubscribeContext(t *testing.T) {
+	srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+	var tenant atomic.String
+	// The interceptor sees the context of the outgoing RPC.
+	interceptor := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if v, ok := ctx.Value(tenantKey{}).(string); ok {
+			tenant.Store(v)
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	var r recorder
+	s := newScraper(t, utils.ComponentTiKV, srv,
+		topsql.WithHandler(r.handle),
+		topsql.WithStreamInterceptors(interceptor),
+		topsql.WithSubscribeContext(func(parent context.Context) context.Context {
+			ctx := context.WithValue(parent, tenantKey{}, "tenant-1")
+			return metadata.AppendToOutgoingContext(ctx, "x-tenant", "tenant-1")
+		}))
+	run(s)
+	waitFor(t, "a record", func() bool { return r.len() > 0 })
+
+	if got := tenant.Load(); got != "tenant-1" {
+		t.Errorf("context value of Subscribe = %q, want %q", got, "tenant-1")
+	}
+	if got := srv.Metadata()[0].Get("x-tenant"); len(got) != 1 || got[0] != "tenant-1" {
+		t.Errorf("x-tenant received by the server = %q, want [tenant-1]", got)
+	}
+}
+
+func TestScraperStreamInterceptors(t *testing.T) {
+	srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	interceptor := func(name string) grpc.StreamClientInterceptor {
+		return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			mu.Lock()
+			calls = append(calls, name+" "+method)
+			mu.Unlock()
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+	}
+	s := newScraper(t, utils.ComponentTiDB, srv, topsql.WithStreamInterceptors(interceptor("first"), interceptor("second")))
+	run(s)
+	waitFor(t, "the subscription", func() bool { return srv.Subscriptions() == 1 })
+	srv.EndStreams(status.Error(codes.Unavailable, "connection dropped"))
+	waitFor(t, "a second subscription", func() bool { return srv.Subscriptions() == 2 })
+
+	const method = "/tipb.TopSQLPubSub/Subscribe"
+	want := []string{"first " + method, "second " + method, "first " + method, "second " + method}
+	mu.Lock()
+	got := append([]string(nil), calls...)
+	mu.Unlock()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("interceptor calls = %q, want %q", got, want)
+	}
+	if got := s.DialSettings().StreamInterceptors; got != 2 {
+		t.Errorf("DialSettings().StreamInterceptors = %d, want 2", got)
+	}
+}
+
+func TestScraperTiFlash(t *testing.T) {
+	// TiFlash speaks the resource metering protocol of TiKV.
+	srv := newServer(t, topsqltest.Config{Count: 2})
+	var r recorder
+	s := newScraper(t, utils.ComponentTiFlash, srv, topsql.WithHandler(r.handle))
+	if err := waitRun(t, run(s)); err != nil {
+		t.Fatalf("Run() = %v, want nil once the stream is ended", err)
+	}
+	records := r.get()
+	if len(records) != 2 {
+		t.Fatalf("received %d records, want 2", len(records))
+	}
+	for _, record := range records {
+		if record.TiKV.GetRecord() == nil || record.TiDB != nil {
+			t.Errorf("record = %+v, want a resource usage record", record)
+		}
+		if record.Component.Kind != utils.ComponentTiFlash {
+			t.Errorf("record component kind = %q, want %q", record.Component.Kind, utils.ComponentTiFlash)
+		}
+	}
+}
+
+func TestScraperCancellationScopes(t *testing.T) {
+	t.Run("stream", func(t *testing.T) {
+		srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+		var r recorder
+		s := newScraper(t, utils.ComponentTiDB, srv, topsql.WithHandler(r.handle))
+		errCh := run(s)
+		waitFor(t, "the first record", func() bool { return r.len() > 0 })
+
+		// Reconnect cancels the stream only, which is then re-established.
+		s.Reconnect()
+		waitFor(t, "a second subscription", func() bool { return srv.Subscriptions() == 2 })
+		n := r.len()
+		waitFor(t, "records after reconnecting", func() bool { return r.len() > n })
+		if s.IsDown() {
+			t.Fatal("scraper is down after Reconnect")
+		}
+		if got := s.Status().LastError; got != nil {
+			t.Errorf("LastError = %v, want nil after a deliberate reconnect", got)
+		}
+
+		s.Close()
+		if err := waitRun(t, errCh); err != nil {
+			t.Errorf("Run() = %v, want nil once closed", err)
+		}
+		if got := s.DownReason(); !errors.Is(got, topsql.ErrClosed) {
+			t.Errorf("DownReason() = %v, want ErrClosed", got)
+		}
+	})
+	t.Run("scraper", func(t *testing.T) {
+		srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var r recorder
+		s := topsql.NewScraper(ctx, utils.Component{Kind: utils.ComponentTiDB, Addr: "127.0.0.1:10080"}, nil,
+			topsql.WithContextDialer(srv.Dialer()), topsql.WithHandler(r.handle))
+		errCh := run(s)
+		waitFor(t, "the first record", func() bool { return r.len() > 0 })
+
+		// Cancelling the parent context stops the whole scraper.
+		cancel()
+		if err := waitRun(t, errCh); err != nil {
+			t.Errorf("Run() = %v, want nil once the context is cancelled", err)
+		}
+		if got := s.DownReason(); !errors.Is(got, context.Canceled) {
+			t.Errorf("DownReason() = %v, want context.Canceled", got)
+		}
+		if got := srv.Subscriptions(); got != 1 {
+			t.Errorf("Subscriptions() = %d, want no reconnect", got)
+		}
+	})
+}
+
+// observeLogs captures the logs of the test at all levels.
+func observeLogs(t *testing.T) *observer.ObservedLogs {
+	core, logs := observer.New(zapcore.DebugLevel)
+	restore := log.ReplaceGlobals(zap.New(core), &log.ZapProperties{Core: core, Level: zap.NewAtomicLevelAt(zapcore.DebugLevel)})
+	t.Cleanup(restore)
+	return logs
+}
+
+func TestScraperCloseLogsNoFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// start starts a scraper, returning it once Close would race with an
+		// operation in flight.
+		start func(t *testing.T) *topsql.Scraper
+	}{
+		{"recv", func(t *testing.T) *topsql.Scraper {
+			srv := newServer(t, topsqltest.Config{FirstRecordDelay: time.Hour})
+			s := newScraper(t, utils.ComponentTiDB, srv)
+			run(s)
+			waitFor(t, "the subscription", func() bool { return srv.Subscriptions() == 1 })
+			return s
+		}},
+		{"dial", func(t *testing.T) *topsql.Scraper {
+			dialing := make(chan struct{})
+			var once sync.Once
+			s := topsql.NewScraper(context.Background(), utils.Component{Kind: utils.ComponentTiKV, Addr: "127.0.0.1:10080"}, nil,
+				topsql.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+					once.Do(func() { close(dialing) })
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}))
+			t.Cleanup(s.Close)
+			run(s)
+			<-dialing
+			return s
+		}},
+		{"reconnect", func(t *testing.T) *topsql.Scraper {
+			srv := newServer(t, topsqltest.Config{Interval: time.Millisecond})
+			var r recorder
+			s := newScraper(t, utils.ComponentTiDB, srv, topsql.WithHandler(r.handle), topsql.WithMinReconnectInterval(0))
+			run(s)
+			waitFor(t, "a record", func() bool { return r.len() > 0 })
+			s.Reconnect()
+			return s
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := observeLogs(t)
+			s := tc.start(t)
+			s.Close()
+			if logs.FilterMessage("Starting Top SQL scraping").Len() == 0 {
+				t.Fatal("logs of the scraper are not captured")
+			}
+			for _, entry := range logs.All() {
+				if entry.Level >= zapcore.WarnLevel {
+					t.Errorf("logged %s %q %v while closing, want nothing above info", entry.Level, entry.Message, entry.ContextMap())
+				}
+			}
+		})
+	}
+}
+
+func TestScraperMixedStreamDeliversPendingRecords(t *testing.T) {
+	// Each stream sends a single record and ends.
+	srv := newServer(t, topsqltest.Config{Count: 1})
+	var r recorder
+	release := make(chan struct{})
+	s := newScraper(t, utils.ComponentTiDBTiKV, srv, topsql.WithHandler(func(record topsql.ScrapedRecord) error {
+		if r.len() == 0 {
+			// Meanwhile the record of the other stream is received and the
+			// first stream ends.
+			<-release
+		}
+		return r.handle(record)
+	}))
+	errCh := run(s)
+	waitFor(t, "both subscriptions", func() bool { return srv.Subscriptions() == 2 })
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	if err := waitRun(t, errCh); err != nil {
+		t.Errorf("Run() = %v, want nil once the streams are ended", err)
+	}
+	var tidb, tikv int
+	for _, record := range r.get() {
+		if record.TiDB != nil {
+			tidb++
+		}
+		if record.TiKV != nil {
+			tikv++
+		}
+	}
+	if tidb != 1 || tikv != 1 {
+		t.Errorf("received %d TiDB and %d TiKV records, want 1 each", tidb, tikv)
+	}
+}
+
+func TestScraperFirstRecvRetryTimes(t *testing.T) {
+	const recvTimeout = time.Second
+	clock := topsqltest.NewClock(time.Now())
+	// The first record of every subscription takes longer than the timeout.
+	srv := newServer(t, topsqltest.Config{FirstRecordDelay: time.Hour})
+	var dials atomic.Int32
+	dialer := srv.Dialer()
+	s := newScraper(t, utils.ComponentTiDB, srv,
+		topsql.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			dials.Inc()
+			return dialer(ctx, addr)
+		}),
+		topsql.WithClock(clock),
+		topsql.WithRecvTimeout(recvTimeout),
+		topsql.WithFirstRecvRetryTimes(2))
+	run(s)
+
+	// The first Recv is retried twice over the same connection.
+	for i := 1; i <= 3; i++ {
+		waitFor(t, "the subscription", func() bool { return srv.Subscriptions() == i })
+		waitFor(t, "the first Recv to wait", func() bool { return clock.Timers() > 0 })
+		if got := dials.Load(); got != 1 {
+			t.Fatalf("dialed %d times by subscription %d, want 1", got, i)
+		}
+		clock.Advance(recvTimeout)
+	}
+
+	// Then the subscription fails and the target is dialed again after the
+	// backoff.
+	waitFor(t, "the backoff", func() bool { return clock.Timers() > 0 })
+	if got := s.Stats().SubscribeAttempts; got != 1 {
+		t.Errorf("SubscribeAttempts = %d before the backoff elapsed, want 1", got)
+	}
+	clock.Advance(s.Stats().FirstWaitTime)
+	waitFor(t, "the second dial", func() bool { return dials.Load() == 2 && srv.Subscriptions() == 4 })
+}
+
+func TestScraperMaxDuration(t *testing.T) {
+	const maxDuration = time.Minute
+	logs := observeLogs(t)
+	clock := topsqltest.NewClock(time.Now())
+	srv := newServer(t, topsqltest.Config{Interval: 10 * time.Millisecond})
+	var rec recorder
+	s := newScraper(t, utils.ComponentTiDB, srv,
+		topsql.WithClock(clock),
+		topsql.WithMaxDuration(maxDuration),
+		topsql.WithHandler(rec.handle))
+	errCh := run(s)
+
+	waitFor(t, "records", func() bool { return rec.len() > 0 })
+	clock.Advance(maxDuration - time.Millisecond)
+	select {
+	case <-s.Done():
+		t.Fatal("stopped before MaxDuration elapsed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Millisecond)
+	if err := waitRun(t, errCh); err != nil {
+		t.Fatalf("Run = %v, want nil", err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("Done not closed after Run returned")
+	}
+	if err := s.DownReason(); !errors.Is(err, topsql.ErrFinished) {
+		t.Errorf("DownReason = %v, want ErrFinished", err)
+	}
+	if logs.FilterMessage("Stopped Top SQL scraping after max duration elapsed").Len() != 1 {
+		t.Error("no summary logged")
+	}
+}
+
+func TestScraperUserAgent(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []topsql.Option
+		want string
+	}{
+		{name: "default", want: topsql.DefaultUserAgent},
+		{name: "configured", opts: []topsql.Option{topsql.WithUserAgent("capture-job/1.0")}, want: "capture-job/1.0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newServer(t, topsqltest.Config{})
+			s := newScraper(t, utils.ComponentTiDB, srv, tc.opts...)
+			run(s)
+
+			waitFor(t, "the subscription", func() bool { return srv.Subscriptions() > 0 })
+			if got := s.DialSettings().UserAgent; got != tc.want {
+				t.Errorf("DialSettings().UserAgent = %q, want %q", got, tc.want)
+			}
+			// gRPC appends its own user agent.
+			ua := srv.Metadata()[0].Get("user-agent")
+			if len(ua) != 1 || !strings.HasPrefix(ua[0], tc.want+" grpc-go/") {
+				t.Errorf("user-agent = %q, want %q followed by the gRPC one", ua, tc.want)
+			}
+		})
+	}
+}
+
+func TestScraperRetryBudgets(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// fail makes every dial or every subscription fail.
+		fail                          topsql.Option
+		err                           error
+		dialRetried, subscribeRetried uint
+	}{
+		{
+			name: "dial",
+			fail: topsql.WithClientConnFactory(func(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+				return nil, errors.New("target down")
+			}, false),
+			err:         topsql.ErrDialRetryExhausted,
+			dialRetried: 3,
+		},
+		{
+			name: "subscribe",
+			fail: topsql.WithStreamInterceptors(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return nil, status.Error(codes.Unavailable, "subscribe rejected")
+			}),
+			err:              topsql.ErrSubscribeRetryExhausted,
+			subscribeRetried: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newServer(t, topsqltest.Config{})
+			s := newScraper(t, utils.ComponentTiDB, srv, tc.fail, topsql.WithRetry(time.Millisecond, 3, 1))
+
+			if err := waitRun(t, run(s)); !errors.Is(err, tc.err) {
+				t.Fatalf("Run = %v, want %v", err, tc.err)
+			}
+			stats := s.Stats()
+			if stats.DialRetried != tc.dialRetried || stats.SubscribeRetried != tc.subscribeRetried {
+				t.Errorf("DialRetried, SubscribeRetried = %d, %d, want %d, %d",
+					stats.DialRetried, stats.SubscribeRetried, tc.dialRetried, tc.subscribeRetried)
+			}
+			if stats.MaxDialRetryTimes != 3 || stats.MaxSubscribeRetryTimes != 1 || stats.MaxRetryTimes != 4 {
+				t.Errorf("MaxDialRetryTimes, MaxSubscribeRetryTimes, MaxRetryTimes = %d, %d, %d, want 3, 1, 4",
+					stats.MaxDialRetryTimes, stats.MaxSubscribeRetryTimes, stats.MaxRetryTimes)
+			}
+			if stats.Retried != stats.DialRetried+stats.SubscribeRetried {
+				t.Errorf("Retried = %d, want the sum of DialRetried and SubscribeRetried", stats.Retried)
+			}
+		})
+	}
+}
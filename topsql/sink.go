@@ -0,0 +1,92 @@
+package topsql
+
+import (
+	"sync"
+
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// Sink is a destination of records, e.g. a message bus, driven by the
+// RecordHandler returned by SinkHandler.
+//
+// Write is called from the scrape goroutines and must be safe for concurrent
+// use when the sink is shared by many scrapers. It should not block for long,
+// as the scraper stops reading from its target meanwhile. An error returned
+// by Write is logged and the record is not written again, so a sink wanting
+// to retry failed writes must do it internally, e.g. by buffering records to
+// retry in a later Write or in Flush. Flush writes out everything buffered
+// so far, and Close flushes and releases the sink, after which it is not
+// written to again.
+type Sink interface {
+	Write(record ScrapedRecord) error
+	Flush() error
+	Close() error
+}
+
+var _ Sink = (*FileSink)(nil)
+
+// SinkHandler returns a RecordHandler writing every record to the sink.
+func SinkHandler(sink Sink) RecordHandler {
+	return sink.Write
+}
+
+// NopSink discards all records.
+var NopSink Sink = nopSink{}
+
+type nopSink struct{}
+
+func (nopSink) Write(ScrapedRecord) error { return nil }
+
+func (nopSink) Flush() error { return nil }
+
+func (nopSink) Close() error { return nil }
+
+// RecordSink receives the raw records of a scraper, see
+// ScraperConfig.RecordSink.
+type RecordSink interface {
+	OnTiDBRecord(*tipb.TopSQLSubResponse)
+	OnTiKVRecord(*resource_usage_agent.ResourceUsageRecord)
+}
+
+// recordSinkHandler passes records to a RecordSink until closed. Closing
+// waits for a call in progress, so that the sink is never called after close
+// returns.
+type recordSinkHandler struct {
+	sink RecordSink
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (h *recordSinkHandler) handle(record ScrapedRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	switch {
+	case record.TiDB != nil:
+		h.sink.OnTiDBRecord(record.TiDB)
+	case record.TiKV != nil:
+		h.sink.OnTiKVRecord(record.TiKV)
+	}
+}
+
+func (h *recordSinkHandler) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+}
+
+// before returns a RecordHandler passing records to the sink before
+// handler, if any.
+func (h *recordSinkHandler) before(handler RecordHandler) RecordHandler {
+	return func(record ScrapedRecord) error {
+		h.handle(record)
+		if handler == nil {
+			return nil
+		}
+		return handler(record)
+	}
+}
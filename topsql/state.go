@@ -0,0 +1,112 @@
+package topsql
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const stateVersion = 1
+
+var errScraperStarted = errors.New("scraper has already started")
+
+// scraperState is the state of a scraper handed off to a new process.
+type scraperState struct {
+	Version    int       `json:"version"`
+	Component  string    `json:"component"` // informational only
+	SessionID  string    `json:"session_id"`
+	StartedAt  time.Time `json:"started_at"`
+	ResumeFrom int64     `json:"resume_from,omitempty"` // unix seconds
+
+	Records              uint64 `json:"records"`
+	Bytes                uint64 `json:"bytes"`
+	Filtered             uint64 `json:"filtered"`
+	TransformDropped     uint64 `json:"transform_dropped"`
+	TeeDropped           uint64 `json:"tee_dropped"`
+	QueueDropped         uint64 `json:"queue_dropped"`
+	Duplicates           uint64 `json:"duplicates"`
+	Degraded             uint64 `json:"degraded"`
+	KeepaliveDisconnects uint64 `json:"keepalive_disconnects"`
+	SubscribeAttempts    uint64 `json:"subscribe_attempts"`
+	SubscribeSuccesses   uint64 `json:"subscribe_successes"`
+	OutOfOrder           uint64 `json:"out_of_order"`
+}
+
+// MarshalState serializes the state of the scraper to be restored by
+// RestoreState in another process, e.g. to keep the session and the counters
+// across a rolling upgrade of the collector. It is best called once the
+// scraper has stopped, as counters are read one by one while it runs.
+//
+// The state consists of the session, i.e. its ID and start time, the latest
+// timestamp received, and the cumulative counters of Stats. Everything else
+// is not preserved: the connection is always established anew, and the retry
+// state, record rates, clock skew, uptime and downtime, DeltaStats and the
+// count of delivered records limited by MaxRecords start over.
+func (s *Scraper) MarshalState() ([]byte, error) {
+	return json.Marshal(scraperState{
+		Version:    stateVersion,
+		Component:  s.component.String(),
+		SessionID:  s.cfg.SessionID,
+		StartedAt:  s.startedAt,
+		ResumeFrom: s.bo.resumeFrom.Load(),
+
+		Records:              s.records.Load(),
+		Bytes:                s.bytes.Load(),
+		Filtered:             s.filtered.Load(),
+		TransformDropped:     s.transformDropped.Load(),
+		TeeDropped:           s.teeDropped.Load(),
+		QueueDropped:         s.queueDropped.Load(),
+		Duplicates:           s.duplicates.Load(),
+		Degraded:             s.degraded.Load(),
+		KeepaliveDisconnects: s.bo.keepaliveDisconnects.Load(),
+		SubscribeAttempts:    s.bo.subscribeAttempts.Load(),
+		SubscribeSuccesses:   s.bo.subscribeSuccesses.Load(),
+		OutOfOrder:           s.bo.outOfOrder.Load(),
+	})
+}
+
+// RestoreState restores the state serialized by MarshalState, see there for
+// what is preserved. It must be called before the scraper starts dialing, so
+// the scraper must be created with ScraperConfig.Lazy and RestoreState called
+// before Connect, without calling any other method concurrently.
+func (s *Scraper) RestoreState(data []byte) error {
+	select {
+	case <-s.connect:
+		return errScraperStarted
+	default:
+	}
+
+	var state scraperState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("decode scraper state: %w", err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("unsupported scraper state version %d", state.Version)
+	}
+
+	if state.SessionID != "" {
+		deleteScraperMetrics(s.component, s.cfg.SessionID)
+		s.cfg.SessionID = state.SessionID
+		s.bo.cfg.SessionID = state.SessionID
+		s.bo.metrics = newScraperMetrics(s.component, state.SessionID)
+	}
+	if !state.StartedAt.IsZero() {
+		s.startedAt = state.StartedAt
+	}
+	s.bo.resumeFrom.Store(state.ResumeFrom)
+
+	s.records.Store(state.Records)
+	s.bytes.Store(state.Bytes)
+	s.filtered.Store(state.Filtered)
+	s.transformDropped.Store(state.TransformDropped)
+	s.teeDropped.Store(state.TeeDropped)
+	s.queueDropped.Store(state.QueueDropped)
+	s.duplicates.Store(state.Duplicates)
+	s.degraded.Store(state.Degraded)
+	s.bo.keepaliveDisconnects.Store(state.KeepaliveDisconnects)
+	s.bo.subscribeAttempts.Store(state.SubscribeAttempts)
+	s.bo.subscribeSuccesses.Store(state.SubscribeSuccesses)
+	s.bo.outOfOrder.Store(state.OutOfOrder)
+	return nil
+}
@@ -0,0 +1,203 @@
+package topsql
+
+import (
+	"time"
+)
+
+type Stats struct {
+	// Retried is the position in the current reconnect retry sequence, the
+	// sum of DialRetried and SubscribeRetried. They are reset to zero once a
+	// subscription has been established successfully.
+	Retried uint
+	// MaxRetryTimes bounds Retried: it is the sum of MaxDialRetryTimes and
+	// MaxSubscribeRetryTimes.
+	MaxRetryTimes uint
+	// DialRetried and SubscribeRetried are the numbers of retries of failed
+	// dials and of failed subscriptions in the current reconnect. They are
+	// spent from separate budgets, of MaxDialRetryTimes and
+	// MaxSubscribeRetryTimes retries, and the scraper gives up with
+	// ErrDialRetryExhausted or ErrSubscribeRetryExhausted once either stage
+	// fails again after using up its budget.
+	DialRetried            uint
+	SubscribeRetried       uint
+	MaxDialRetryTimes      uint
+	MaxSubscribeRetryTimes uint
+	// FirstWaitTime is the effective wait before the first retry, which
+	// differs from the configured one when adaptive backoff is enabled.
+	FirstWaitTime time.Duration
+	// Encrypted reports whether the last dial used TLS.
+	Encrypted bool
+	// Records and Bytes are the number and total size of received records.
+	Records uint64
+	Bytes   uint64
+	// FastRecordsPerSecond and SlowRecordsPerSecond are moving averages of
+	// the record rate over ScraperConfig.FastRateWindow and SlowRateWindow.
+	// The fast one crossing the slow one indicates a trend change.
+	FastRecordsPerSecond float64
+	SlowRecordsPerSecond float64
+	// KeepaliveDisconnects is the number of connections found dead because
+	// keepalive pings were not acknowledged.
+	KeepaliveDisconnects uint64
+	// ClockSkew is the receive time minus the latest timestamp of the last
+	// record with data points.
+	ClockSkew time.Duration
+	// Filtered is the number of records dropped by the client side filters:
+	// ScraperConfig.ResourceGroupAllowlist, ResourceGroupDenylist and
+	// SQLDigestAllowlist.
+	Filtered uint64
+	// TransformDropped is the number of records dropped by
+	// ScraperConfig.Transform.
+	TransformDropped uint64
+	// TeeDropped is the number of records not copied to ScraperConfig.Tee
+	// because it was full.
+	TeeDropped uint64
+	// QueueDropped is the number of records not queued because the queue was
+	// full, with ScraperConfig.QueueDrop set.
+	QueueDropped uint64
+	// Duplicates is the number of records dropped as already received, with
+	// ScraperConfig.DedupWindow set.
+	Duplicates uint64
+	// Degraded is the number of records received with ScrapedRecord.Degraded
+	// set.
+	Degraded uint64
+	// SubscribeAttempts is the number of attempts to dial and subscribe to
+	// the target, of which SubscribeSuccesses established a subscription.
+	SubscribeAttempts  uint64
+	SubscribeSuccesses uint64
+	// OutOfOrder is the number of records with data points earlier than the
+	// ones of previous records of the same stream, beyond the spread of a
+	// single report. Records out of order indicate a server side issue.
+	OutOfOrder uint64
+	// Uptime and Downtime are the total durations the scraper has been
+	// subscribed to the target and not, e.g. connecting or reconnecting,
+	// since it was created.
+	Uptime   time.Duration
+	Downtime time.Duration
+	// LastDialDuration and AvgDialDuration are the time taken by the last and
+	// on average by all successful dials. Dials getting slow often precede
+	// instability of the target.
+	LastDialDuration time.Duration
+	AvgDialDuration  time.Duration
+	// ServerVersion is the version advertised by the server on the last
+	// subscription, "unknown" if not advertised, or empty before the first
+	// subscription.
+	ServerVersion string
+}
+
+func (s *Scraper) Stats() Stats {
+	now := s.cfg.Clock.Now()
+	s.bo.updateMu.Lock()
+	maxDialRetryTimes, maxSubscribeRetryTimes := s.bo.cfg.MaxRetryTimes, s.bo.subscribeRetryTimes()
+	s.bo.updateMu.Unlock()
+	stats := Stats{
+		Retried:       uint(s.bo.retried.Load()),
+		MaxRetryTimes: maxDialRetryTimes + maxSubscribeRetryTimes,
+
+		DialRetried:            uint(s.bo.dialRetried.Load()),
+		SubscribeRetried:       uint(s.bo.subscribeRetried.Load()),
+		MaxDialRetryTimes:      maxDialRetryTimes,
+		MaxSubscribeRetryTimes: maxSubscribeRetryTimes,
+
+		FirstWaitTime: s.bo.firstWaitTime.Load(),
+		Encrypted:     s.bo.encrypted.Load(),
+		Records:       s.records.Load(),
+		Bytes:         s.bytes.Load(),
+		Filtered:      s.filtered.Load(),
+
+		TransformDropped:   s.transformDropped.Load(),
+		TeeDropped:         s.teeDropped.Load(),
+		QueueDropped:       s.queueDropped.Load(),
+		Duplicates:         s.duplicates.Load(),
+		Degraded:           s.degraded.Load(),
+		SubscribeAttempts:  s.bo.subscribeAttempts.Load(),
+		SubscribeSuccesses: s.bo.subscribeSuccesses.Load(),
+		OutOfOrder:         s.bo.outOfOrder.Load(),
+		Uptime:             time.Duration(s.bo.uptime.Load()),
+		Downtime:           time.Duration(s.bo.downtime.Load()),
+
+		KeepaliveDisconnects: s.bo.keepaliveDisconnects.Load(),
+		ClockSkew:            s.clockSkew.Load(),
+
+		FastRecordsPerSecond: s.fastRate.value(now),
+		SlowRecordsPerSecond: s.slowRate.value(now),
+	}
+	stats.ServerVersion = s.bo.serverVersion.Load()
+	stats.LastDialDuration = s.bo.lastDialDuration.Load()
+	if dials := s.bo.dials.Load(); dials > 0 {
+		stats.AvgDialDuration = s.bo.totalDialDuration.Load() / time.Duration(dials)
+	}
+	// Add the current period.
+	if lostAt := s.bo.streamLostAt.Load(); lostAt != 0 {
+		stats.Downtime += now.Sub(time.Unix(0, lostAt))
+	} else {
+		stats.Uptime += now.Sub(time.Unix(0, s.bo.streamUpAt.Load()))
+	}
+	return stats
+}
+
+// ResetStats zeroes the cumulative counters of Stats: Records, Bytes,
+// KeepaliveDisconnects, Filtered, TransformDropped, TeeDropped, QueueDropped,
+// Duplicates, Degraded, SubscribeAttempts, SubscribeSuccesses and
+// OutOfOrder, as well as DeltaStats. The connection is left untouched, and so
+// are the stats describing it and the retries: Retried, DialRetried,
+// SubscribeRetried and their maximums, FirstWaitTime, Encrypted,
+// ServerVersion and the dial durations. So are the record rates, the clock
+// skew, uptime and downtime, and the count of delivered records limited by
+// MaxRecords. Each counter is cleared
+// atomically, but not all of them at once with respect to a record being
+// counted concurrently.
+func (s *Scraper) ResetStats() {
+	s.records.Store(0)
+	s.bytes.Store(0)
+	s.deltaRecords.Store(0)
+	s.deltaBytes.Store(0)
+	s.filtered.Store(0)
+	s.transformDropped.Store(0)
+	s.teeDropped.Store(0)
+	s.queueDropped.Store(0)
+	s.duplicates.Store(0)
+	s.degraded.Store(0)
+	s.bo.keepaliveDisconnects.Store(0)
+	s.bo.subscribeAttempts.Store(0)
+	s.bo.subscribeSuccesses.Store(0)
+	s.bo.outOfOrder.Store(0)
+}
+
+// SubscribeSuccessRatio returns the ratio of attempts to dial and subscribe
+// that established a subscription over the lifetime of the scraper, or 1
+// before the first attempt. A low ratio indicates a chronically unhealthy
+// target.
+func (s *Scraper) SubscribeSuccessRatio() float64 {
+	// Successes are loaded first, so that they never exceed the attempts.
+	successes := s.bo.subscribeSuccesses.Load()
+	attempts := s.bo.subscribeAttempts.Load()
+	if attempts == 0 {
+		return 1
+	}
+	return float64(successes) / float64(attempts)
+}
+
+// DeltaStats returns the number and total size of records received since the
+// previous call of DeltaStats.
+func (s *Scraper) DeltaStats() (records uint64, bytes uint64) {
+	return s.deltaRecords.Swap(0), s.deltaBytes.Swap(0)
+}
+
+func (s *Scraper) countRecord(size int) {
+	s.records.Inc()
+	s.bytes.Add(uint64(size))
+	s.deltaRecords.Inc()
+	s.deltaBytes.Add(uint64(size))
+
+	now := s.cfg.Clock.Now()
+	s.fastRate.add(now, 1)
+	s.slowRate.add(now, 1)
+
+	// The first record of a stream waited for the (re)connect as well.
+	if !s.lastArrival.IsZero() && s.lastArrival.UnixNano() >= s.bo.streamUpAt.Load() {
+		s.bo.metrics.interArrival.Observe(now.Sub(s.lastArrival).Seconds())
+	}
+	s.lastArrival = now
+	s.lastRecordAt.Store(now.UnixNano())
+	s.bo.metrics.records.Inc()
+}
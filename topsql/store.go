@@ -0,0 +1,187 @@
+package topsql
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+var errStoreClosed = errors.New("store closed")
+
+// Store keeps the records received within the last retention in memory, to
+// be queried by component and time. It is a Sink safe for concurrent use by
+// many scrapers and query callers, passed to them with
+// WithHandler(SinkHandler(store)).
+//
+// Records of every component are bucketed by the minute they are received
+// in. A bucket holds up to maxPerBucket records, which must be positive, and
+// later ones of the same minute are dropped and counted in Dropped. Buckets
+// past the retention are evicted by Run. Heartbeat records carry no data and
+// are not stored. Records of scrapers enabling PoolRecords are copied, so
+// they may be released once Write returns.
+type Store struct {
+	retention    time.Duration
+	maxPerBucket int
+
+	mu     sync.RWMutex
+	series map[storeKey][]*storeBucket // oldest first
+	closed bool
+
+	dropped atomic.Uint64
+}
+
+// storeKey identifies a component regardless of its scheduling attributes.
+type storeKey struct {
+	kind utils.ComponentKind
+	addr string
+	name string
+}
+
+func storeKeyOf(component utils.Component) storeKey {
+	return storeKey{kind: component.Kind, addr: component.Addr, name: component.Name}
+}
+
+type storeBucket struct {
+	minute  time.Time
+	records []ScrapedRecord
+}
+
+func NewStore(retention time.Duration, maxPerBucket int) *Store {
+	return &Store{
+		retention:    retention,
+		maxPerBucket: maxPerBucket,
+		series:       make(map[storeKey][]*storeBucket),
+	}
+}
+
+// Write adds the record to the bucket of the minute it was received in.
+func (s *Store) Write(record ScrapedRecord) error {
+	if record.Heartbeat {
+		return nil
+	}
+	minute := record.ReceivedAt.Truncate(time.Minute)
+	key := storeKeyOf(record.Component)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	buckets := s.series[key]
+	// Records mostly arrive in order, so the bucket is usually the last one.
+	i := len(buckets)
+	for i > 0 && buckets[i-1].minute.After(minute) {
+		i--
+	}
+	if i == 0 || !buckets[i-1].minute.Equal(minute) {
+		buckets = append(buckets, nil)
+		copy(buckets[i+1:], buckets[i:])
+		buckets[i] = &storeBucket{minute: minute}
+		s.series[key] = buckets
+		i++
+	}
+	bucket := buckets[i-1]
+	if len(bucket.records) >= s.maxPerBucket {
+		s.dropped.Inc()
+		return nil
+	}
+	bucket.records = append(bucket.records, record.retain())
+	return nil
+}
+
+func (s *Store) Flush() error { return nil }
+
+// Close releases all records. Queries return nothing afterwards.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.series = make(map[storeKey][]*storeBucket)
+	return nil
+}
+
+// Query returns the records of the component received within [from, to), in
+// the order they were received per minute.
+func (s *Store) Query(component utils.Component, from, to time.Time) []ScrapedRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	buckets := s.series[storeKeyOf(component)]
+	// Skip buckets ending before from.
+	i := sort.Search(len(buckets), func(i int) bool {
+		return buckets[i].minute.Add(time.Minute).After(from)
+	})
+	var records []ScrapedRecord
+	for _, bucket := range buckets[i:] {
+		if !bucket.minute.Before(to) {
+			break
+		}
+		for _, record := range bucket.records {
+			if !record.ReceivedAt.Before(from) && record.ReceivedAt.Before(to) {
+				records = append(records, record)
+			}
+		}
+	}
+	return records
+}
+
+// Dropped returns the number of records dropped as their buckets were full.
+func (s *Store) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Run evicts buckets past the retention every minute, until ctx is done.
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.evict(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evict removes the buckets ending before the retention as of now.
+func (s *Store) evict(now time.Time) {
+	cutoff := now.Add(-s.retention)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, buckets := range s.series {
+		i := 0
+		for i < len(buckets) && !buckets[i].minute.Add(time.Minute).After(cutoff) {
+			buckets[i] = nil
+			i++
+		}
+		if i == len(buckets) {
+			delete(s.series, key)
+		} else if i > 0 {
+			s.series[key] = buckets[i:]
+		}
+	}
+}
+
+// Components returns the components with records stored.
+func (s *Store) Components() []utils.Component {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	components := make([]utils.Component, 0, len(s.series))
+	for key := range s.series {
+		components = append(components, utils.Component{Kind: key.kind, Addr: key.addr, Name: key.name})
+	}
+	return components
+}
+
+var (
+	_ Sink          = (*Store)(nil)
+	_ RecordQuerier = (*Store)(nil)
+)
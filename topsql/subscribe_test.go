@@ -0,0 +1,111 @@
+package topsql
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+// nilStreamClient is a misbehaving client returning neither a stream nor an
+// error from Subscribe.
+type nilStreamClient struct {
+	subscribes atomic.Int32
+}
+
+func (c *nilStreamClient) Subscribe(context.Context, *tipb.TopSQLSubRequest, ...grpc.CallOption) (tipb.TopSQLPubSub_SubscribeClient, error) {
+	c.subscribes.Inc()
+	return nil, nil
+}
+
+type nilStreamTiKVClient struct {
+	subscribes atomic.Int32
+}
+
+func (c *nilStreamTiKVClient) Subscribe(context.Context, *resource_usage_agent.ResourceMeteringRequest, ...grpc.CallOption) (resource_usage_agent.ResourceMeteringPubSub_SubscribeClient, error) {
+	c.subscribes.Inc()
+	return nil, nil
+}
+
+// emptyServerDialer returns a dialer to a gRPC server without any service,
+// which the fake clients never call.
+func emptyServerDialer(t *testing.T) func(context.Context, string) (net.Conn, error) {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}
+}
+
+func TestSubscribeNilStream(t *testing.T) {
+	tidb, tikv := &nilStreamClient{}, &nilStreamTiKVClient{}
+	newTiDBClient = func(*grpc.ClientConn) tipb.TopSQLPubSubClient { return tidb }
+	newTiKVClient = func(*grpc.ClientConn) resource_usage_agent.ResourceMeteringPubSubClient { return tikv }
+	defer func() {
+		newTiDBClient = tipb.NewTopSQLPubSubClient
+		newTiKVClient = resource_usage_agent.NewResourceMeteringPubSubClient
+	}()
+
+	for _, tc := range []struct {
+		kind       utils.ComponentKind
+		subscribes func() int32
+	}{
+		{utils.ComponentTiDB, tidb.subscribes.Load},
+		{utils.ComponentTiKV, tikv.subscribes.Load},
+		{utils.ComponentTiDBTiKV, tidb.subscribes.Load},
+	} {
+		t.Run(string(tc.kind), func(t *testing.T) {
+			before := tc.subscribes()
+			s := NewScraper(context.Background(), utils.Component{Kind: tc.kind, Addr: "127.0.0.1:10080"}, nil,
+				WithContextDialer(emptyServerDialer(t)),
+				WithRetry(time.Millisecond, 2, 2),
+				WithMinReconnectInterval(0))
+			defer s.Close()
+
+			// A nil stream must fail the subscription instead of panicking
+			// on the first Recv.
+			if err := s.Run(); !errors.Is(err, ErrRetryExhausted) {
+				t.Errorf("Run() = %v, want ErrRetryExhausted", err)
+			}
+			if got := tc.subscribes() - before; got < 2 {
+				t.Errorf("Subscribe called %d times, want it retried", got)
+			}
+			if got := s.Status().LastError; !errors.Is(got, errNilStream) {
+				t.Errorf("LastError = %v, want errNilStream", got)
+			}
+		})
+	}
+}
+
+func TestRetryWaitIsCapped(t *testing.T) {
+	for _, tc := range []struct {
+		first   time.Duration
+		retried uint
+		want    time.Duration
+	}{
+		{2 * time.Second, 0, 2 * time.Second},
+		{2 * time.Second, 3, 16 * time.Second},
+		{2 * time.Second, 8, maxRetryWait},
+		// Shifting by as much would overflow time.Duration.
+		{2 * time.Second, 40, maxRetryWait},
+		{2 * time.Second, 100, maxRetryWait},
+		{time.Hour, 5, time.Hour},
+	} {
+		if got := retryWait(tc.first, tc.retried); got != tc.want {
+			t.Errorf("retryWait(%v, %d) = %v, want %v", tc.first, tc.retried, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package topsql
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+// TopologyFetcher returns the components of a cluster, e.g. by querying PD.
+type TopologyFetcher func(ctx context.Context) ([]utils.Component, error)
+
+// ScrapersFromTopology creates a pool scraping all the given components.
+func ScrapersFromTopology(ctx context.Context, topo []utils.Component, tlsConfig *tls.Config, cfg PoolConfig) *ScraperPool {
+	p := NewScraperPool(ctx, tlsConfig, cfg)
+	for _, component := range topo {
+		p.Add(component)
+	}
+	return p
+}
+
+// SyncTopology fetches the topology every interval until ctx is done, adding
+// new components to the pool and removing the ones gone. A failed fetch
+// leaves the pool untouched.
+func (p *ScraperPool) SyncTopology(ctx context.Context, fetch TopologyFetcher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		topo, err := fetch(ctx)
+		if err != nil {
+			log.Warn("Failed to fetch topology", zap.Error(err))
+		} else {
+			p.syncTopology(topo)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *ScraperPool) syncTopology(topo []utils.Component) {
+	current := make(map[string]struct{}, len(topo))
+	for _, component := range topo {
+		current[component.Addr] = struct{}{}
+		p.Add(component)
+	}
+	for _, component := range p.List() {
+		if _, ok := current[component.Addr]; !ok {
+			p.Remove(component.Addr)
+		}
+	}
+}
+
+// ParsePDStores parses the response of PD's /pd/api/v1/stores API into TiKV
+// and TiFlash components. Stores being removed or already removed are
+// skipped.
+func ParsePDStores(data []byte) ([]utils.Component, error) {
+	var resp struct {
+		Stores []struct {
+			Store struct {
+				Address   string `json:"address"`
+				StateName string `json:"state_name"`
+				Labels    []struct {
+					Key   string `json:"key"`
+					Value string `json:"value"`
+				} `json:"labels"`
+			} `json:"store"`
+		} `json:"stores"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+
+	var components []utils.Component
+	for _, s := range resp.Stores {
+		if s.Store.StateName == "Offline" || s.Store.StateName == "Tombstone" {
+			continue
+		}
+		kind := utils.ComponentTiKV
+		for _, label := range s.Store.Labels {
+			if label.Key == "engine" && label.Value == "tiflash" {
+				kind = utils.ComponentTiFlash
+			}
+		}
+		components = append(components, utils.Component{
+			Kind: kind,
+			Addr: s.Store.Address,
+		})
+	}
+	return components, nil
+}
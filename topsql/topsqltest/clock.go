@@ -0,0 +1,98 @@
+package topsqltest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+// Clock is a utils.Clock whose time only moves when advanced, so that tests
+// can drive the timing logic of scrapers without real waits.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*clockTimer
+}
+
+type clockTimer struct {
+	at   time.Time
+	fire func()
+}
+
+var _ utils.Clock = (*Clock)(nil)
+
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.add(d, func() { ch <- c.Now() })
+	return ch
+}
+
+func (c *Clock) AfterFunc(d time.Duration, f func()) func() bool {
+	t := c.add(d, func() { go f() })
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, timer := range c.timers {
+			if timer == t {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (c *Clock) add(d time.Duration, fire func()) *clockTimer {
+	c.mu.Lock()
+	t := &clockTimer{at: c.now.Add(d), fire: fire}
+	if d > 0 {
+		c.timers = append(c.timers, t)
+		c.mu.Unlock()
+		return t
+	}
+	c.mu.Unlock()
+	fire()
+	return t
+}
+
+// Advance moves the time forward by d, firing the timers due by then in the
+// order of their deadlines.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due, pending []*clockTimer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		t.fire()
+	}
+}
+
+// Timers returns the number of timers not fired or stopped yet, e.g. to tell
+// that a scraper is waiting.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
@@ -0,0 +1,31 @@
+package topsqltest
+
+import (
+	"strings"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/breeswish/mockngm/topsql"
+)
+
+// recordDiffOptions compare records by what a consumer can observe, i.e. the
+// decoded messages, ignoring the bookkeeping fields generated for gogo
+// messages, which protocmp does not support. Empty and nil slices are equal,
+// as they are on the wire.
+var recordDiffOptions = cmp.Options{
+	cmpopts.IgnoreUnexported(topsql.ScrapedRecord{}),
+	cmpopts.IgnoreFields(topsql.ScrapedRecord{}, "SessionID", "ReceivedAt"),
+	cmp.FilterPath(func(p cmp.Path) bool {
+		sf, ok := p.Last().(cmp.StructField)
+		return ok && strings.HasPrefix(sf.Name(), "XXX_")
+	}, cmp.Ignore()),
+	cmpopts.EquateEmpty(),
+}
+
+// DiffRecords returns a human readable diff of the records in a and b, or an
+// empty string if they are equal. SessionID and ReceivedAt differ from run to
+// run, so they are not compared.
+func DiffRecords(a, b []topsql.ScrapedRecord) string {
+	return cmp.Diff(a, b, recordDiffOptions)
+}
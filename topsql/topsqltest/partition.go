@@ -0,0 +1,23 @@
+package topsqltest
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// PartitionDialer wraps dialer so that every connection it makes is dropped
+// after the given interval, simulating a network partition. The next dial
+// succeeds as usual, so a scraper is expected to recover by reconnecting.
+func PartitionDialer(dialer func(context.Context, string) (net.Conn, error), after time.Duration) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := dialer(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		time.AfterFunc(after, func() {
+			_ = conn.Close()
+		})
+		return conn, nil
+	}
+}
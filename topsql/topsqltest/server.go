@@ -0,0 +1,225 @@
+// Package topsqltest provides an in-process Top SQL pub-sub server for
+// exercising scrapers without a real TiDB or TiKV.
+package topsqltest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const bufSize = 1024 * 1024
+
+type Config struct {
+	// TiDBRecord and TiKVRecord are sent repeatedly to every subscriber.
+	// Defaults to a record with a single data point.
+	TiDBRecord *tipb.TopSQLSubResponse
+	TiKVRecord *resource_usage_agent.ResourceUsageRecord
+	// Interval is the wait time between two records of a subscription. Zero
+	// streams records as fast as possible.
+	Interval time.Duration
+	// FirstRecordDelay is the wait time before the first record of a
+	// subscription, e.g. to emulate a target slow to send or silent.
+	FirstRecordDelay time.Duration
+	// Count is the number of records sent on a subscription before the
+	// stream is ended. Zero sends records until the subscriber goes away.
+	Count int
+	// FailAfter fails a subscription with codes.Unavailable after sending
+	// this many records, as if the connection was dropped. Zero disables it.
+	FailAfter int
+}
+
+// Server serves both TiDB and TiKV Top SQL subscriptions over an in-memory
+// listener.
+type Server struct {
+	cfg      Config
+	listener *bufconn.Listener
+	server   *grpc.Server
+
+	subscriptions atomic.Int64
+
+	// end is fired by EndStreams to end the current subscriptions, and
+	// replaced for the next ones.
+	mu       sync.Mutex
+	end      *endSignal
+	metadata []metadata.MD
+}
+
+type endSignal struct {
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+func NewServer(cfg Config) *Server {
+	if cfg.TiDBRecord == nil {
+		cfg.TiDBRecord = DefaultTiDBRecord()
+	}
+	if cfg.TiKVRecord == nil {
+		cfg.TiKVRecord = DefaultTiKVRecord()
+	}
+
+	s := &Server{
+		cfg:      cfg,
+		listener: bufconn.Listen(bufSize),
+		server:   grpc.NewServer(),
+		end:      &endSignal{done: make(chan struct{})},
+	}
+	tipb.RegisterTopSQLPubSubServer(s.server, &tidbService{s})
+	resource_usage_agent.RegisterResourceMeteringPubSubServer(s.server, &tikvService{s})
+	go func() {
+		_ = s.server.Serve(s.listener)
+	}()
+	return s
+}
+
+// Dial returns a new client side connection to the server.
+func (s *Server) Dial() (net.Conn, error) {
+	return s.listener.Dial()
+}
+
+// Dialer returns a dialer connecting to the server regardless of the address,
+// to be used with grpc.WithContextDialer.
+func (s *Server) Dialer() func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		return s.listener.Dial()
+	}
+}
+
+func (s *Server) Close() {
+	s.server.Stop()
+}
+
+// EndStreams ends all current subscriptions with err, a status error to be
+// received by subscribers, e.g. status.Error(codes.Unavailable, ...), or nil
+// to end them cleanly with io.EOF. Later subscriptions are not affected.
+func (s *Server) EndStreams(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end.err = err
+	close(s.end.done)
+	s.end = &endSignal{done: make(chan struct{})}
+}
+
+// Subscriptions returns the number of subscriptions served so far, e.g. to
+// tell that a scraper has reconnected.
+func (s *Server) Subscriptions() int {
+	return int(s.subscriptions.Load())
+}
+
+// Metadata returns the metadata received with every subscription so far, in
+// the order they were served, e.g. to check what a scraper sends.
+func (s *Server) Metadata() []metadata.MD {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]metadata.MD(nil), s.metadata...)
+}
+
+// subscribed registers a new subscription, returning the signal ending it.
+func (s *Server) subscribed(ctx context.Context) *endSignal {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions.Inc()
+	s.metadata = append(s.metadata, md)
+	return s.end
+}
+
+// stream sends records via send until the configured count is reached, the
+// subscriber goes away or EndStreams is called.
+func (s *Server) stream(ctx context.Context, send func() error) error {
+	end := s.subscribed(ctx)
+	if s.cfg.FirstRecordDelay > 0 {
+		select {
+		case <-time.After(s.cfg.FirstRecordDelay):
+		case <-end.done:
+			return end.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for i := 0; s.cfg.Count == 0 || i < s.cfg.Count; i++ {
+		if s.cfg.FailAfter > 0 && i >= s.cfg.FailAfter {
+			return status.Error(codes.Unavailable, "injected failure")
+		}
+		select {
+		case <-end.done:
+			return end.err
+		default:
+		}
+		if err := send(); err != nil {
+			return err
+		}
+		if s.cfg.Interval > 0 {
+			select {
+			case <-time.After(s.cfg.Interval):
+			case <-end.done:
+				return end.err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+type tidbService struct {
+	s *Server
+}
+
+func (t *tidbService) Subscribe(_ *tipb.TopSQLSubRequest, stream tipb.TopSQLPubSub_SubscribeServer) error {
+	return t.s.stream(stream.Context(), func() error {
+		return stream.Send(t.s.cfg.TiDBRecord)
+	})
+}
+
+type tikvService struct {
+	s *Server
+}
+
+func (t *tikvService) Subscribe(_ *resource_usage_agent.ResourceMeteringRequest, stream resource_usage_agent.ResourceMeteringPubSub_SubscribeServer) error {
+	return t.s.stream(stream.Context(), func() error {
+		return stream.Send(t.s.cfg.TiKVRecord)
+	})
+}
+
+func DefaultTiDBRecord() *tipb.TopSQLSubResponse {
+	return &tipb.TopSQLSubResponse{
+		RespOneof: &tipb.TopSQLSubResponse_Record{
+			Record: &tipb.TopSQLRecord{
+				SqlDigest:  []byte("sql-digest"),
+				PlanDigest: []byte("plan-digest"),
+				Items: []*tipb.TopSQLRecordItem{{
+					TimestampSec:  uint64(time.Now().Unix()),
+					CpuTimeMs:     100,
+					StmtExecCount: 1,
+				}},
+			},
+		},
+	}
+}
+
+func DefaultTiKVRecord() *resource_usage_agent.ResourceUsageRecord {
+	return &resource_usage_agent.ResourceUsageRecord{
+		RecordOneof: &resource_usage_agent.ResourceUsageRecord_Record{
+			Record: &resource_usage_agent.GroupTagRecord{
+				ResourceGroupTag: []byte("resource-group-tag"),
+				Items: []*resource_usage_agent.GroupTagRecordItem{{
+					TimestampSec: uint64(time.Now().Unix()),
+					CpuTimeMs:    100,
+					ReadKeys:     10,
+					WriteKeys:    1,
+				}},
+			},
+		},
+	}
+}
@@ -0,0 +1,75 @@
+package topsql
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/backoff"
+
+	"github.com/breeswish/mockngm/utils"
+)
+
+func TestValidateAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		err  string // empty if valid
+	}{
+		{"", "missing port"},
+		{"127.0.0.1", "missing port"},
+		{"tidb.local", "missing port"},
+		{":10080", "missing host"},
+		{"127.0.0.1:port", "invalid port"},
+		{"127.0.0.1:70000", "invalid port"},
+		{"127.0.0.1:10080", ""},
+		{"tidb.local:10080", ""},
+		{"[::1]:10080", ""},
+	} {
+		err := validateAddr(tc.addr)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("validateAddr(%q) = %v, want nil", tc.addr, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("validateAddr(%q) = %v, want an error about %s", tc.addr, err, tc.err)
+		}
+	}
+}
+
+func TestRunRejectsInvalidAddrAtOnce(t *testing.T) {
+	s := NewScraper(context.Background(), utils.Component{Kind: utils.ComponentTiDB, Addr: "127.0.0.1"}, nil, WithDialTimeout(time.Minute))
+	defer s.Close()
+	start := time.Now()
+	err := s.Run()
+	if err == nil || !strings.Contains(err.Error(), "invalid address") {
+		t.Errorf("Run() = %v, want an invalid address error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Run() took %v, want it to fail without dialing", elapsed)
+	}
+	if got := s.Stats().SubscribeAttempts; got != 0 {
+		t.Errorf("SubscribeAttempts = %d, want 0", got)
+	}
+}
+
+func TestRunRejectsPartialConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(cfg *ScraperConfig)
+		err    string
+	}{
+		{"max recv msg size", func(cfg *ScraperConfig) { cfg.MaxRecvMsgSize = 0 }, "max receive message size"},
+		{"first wait time", func(cfg *ScraperConfig) { cfg.FirstWaitTime = 0 }, "first wait time"},
+		{"connect backoff", func(cfg *ScraperConfig) { cfg.ConnectBackoff = backoff.Config{} }, "connect backoff"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfigFor(utils.ComponentTiDB)
+			tc.modify(&cfg)
+			s := NewScraper(context.Background(), utils.Component{Kind: utils.ComponentTiDB, Addr: "127.0.0.1:10080"}, nil, WithConfig(cfg))
+			defer s.Close()
+			if err := s.Run(); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Run() = %v, want an error about the %s", err, tc.err)
+			}
+		})
+	}
+}
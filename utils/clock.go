@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"time"
+)
+
+// Clock tells the time and waits for it, so that timing logic can be driven
+// by a fake clock in tests instead of real sleeps.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f in its own goroutine after d, unless stopped before.
+	// stop reports whether it stopped the call.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// RealClock is the Clock of the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"net"
 )
 
 type ComponentKind string
@@ -9,13 +10,80 @@ type ComponentKind string
 const (
 	ComponentTiDB ComponentKind = "tidb"
 	ComponentTiKV ComponentKind = "tikv"
+	// ComponentTiFlash speaks the same resource metering protocol as TiKV.
+	ComponentTiFlash ComponentKind = "tiflash"
+	// ComponentTiDBTiKV is a target serving both TiDB and TiKV Top SQL data,
+	// e.g. a mock server. Both are subscribed over the same connection.
+	ComponentTiDBTiKV ComponentKind = "tidb+tikv"
 )
 
 type Component struct {
 	Kind ComponentKind
 	Addr string // host:port
+	// Weight is the relative priority of the component when a scraper pool
+	// cannot scrape all targets. Zero is treated as 1.
+	Weight uint
+	// Group is a logical group of the component, e.g. a datacenter, allowing
+	// scrapers of the whole group to be operated at once.
+	Group string
+	// Name is a human friendly name of the component, e.g. "prod-tikv-3",
+	// telling apart components of the same address in different clusters. It
+	// is included in logs and metric labels when set.
+	Name string
 }
 
+// ComponentFormat formats a component for display, e.g. in logs.
+type ComponentFormat func(Component) string
+
+var (
+	// FormatURL formats as tidb://127.0.0.1:10080.
+	FormatURL ComponentFormat = func(c Component) string {
+		return fmt.Sprintf("%s://%s", c.Kind, c.Addr)
+	}
+	// FormatKindAt formats as tidb@127.0.0.1:10080.
+	FormatKindAt ComponentFormat = func(c Component) string {
+		return fmt.Sprintf("%s@%s", c.Kind, c.Addr)
+	}
+	// FormatAddr formats as 127.0.0.1:10080.
+	FormatAddr ComponentFormat = func(c Component) string {
+		return c.Addr
+	}
+)
+
+// DefaultComponentFormat is the format used by Component.String. It is not
+// safe to change it while components are being formatted, so set it only at
+// startup.
+var DefaultComponentFormat = FormatURL
+
+// String formats the component with DefaultComponentFormat, prefixed by its
+// name if any, e.g. "prod-tidb-1 (tidb://127.0.0.1:10080)".
 func (c Component) String() string {
-	return fmt.Sprintf("%s://%s", c.Kind, c.Addr)
+	if c.Name != "" {
+		return fmt.Sprintf("%s (%s)", c.Name, c.FormatAs(DefaultComponentFormat))
+	}
+	return c.FormatAs(DefaultComponentFormat)
+}
+
+func (c Component) FormatAs(format ComponentFormat) string {
+	return format(c)
+}
+
+// InferKind guesses the kind of the component at addr from its port, which is
+// only a heuristic based on the default ports: 10080 is the TiDB status port,
+// and 20160 and 20180 are the TiKV server and status ports. Components on
+// other ports are not recognized, and ones on a default port of another
+// component are guessed wrong, so an explicitly given kind always takes
+// precedence.
+func InferKind(addr string) (ComponentKind, bool) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	switch port {
+	case "10080":
+		return ComponentTiDB, true
+	case "20160", "20180":
+		return ComponentTiKV, true
+	}
+	return "", false
 }
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"context"
+	"math"
 	"time"
 )
 
@@ -17,6 +18,12 @@ import (
 //
 // The argument provided for f is the retried times.
 func WithRetryBackoff(ctx context.Context, maxRetryTimes uint, firstDuration time.Duration, f func(uint) bool) {
+	WithRetryBackoffClock(ctx, RealClock, maxRetryTimes, firstDuration, math.MaxInt64, f)
+}
+
+// WithRetryBackoffClock is WithRetryBackoff waiting on the given clock, with
+// the doubling wait capped at maxDuration.
+func WithRetryBackoffClock(ctx context.Context, clock Clock, maxRetryTimes uint, firstDuration, maxDuration time.Duration, f func(uint) bool) {
 	duration := firstDuration
 	for retried := uint(0); retried <= maxRetryTimes; retried++ {
 		if done := f(retried); done {
@@ -24,11 +31,15 @@ func WithRetryBackoff(ctx context.Context, maxRetryTimes uint, firstDuration tim
 		}
 		if retried < maxRetryTimes {
 			select {
-			case <-time.After(duration):
+			case <-clock.After(duration):
 			case <-ctx.Done():
 				return
 			}
-			duration *= 2
+			if duration > maxDuration/2 {
+				duration = maxDuration
+			} else {
+				duration *= 2
+			}
 		}
 	}
 }